@@ -1,11 +1,73 @@
 package disgo
 
+import "time"
+
+// SearchOptions pages through search results.  Pages are only consistent
+// for indexes that return matches in a fixed order, such as RadixIndex
+type SearchOptions struct {
+	// Offset is the number of matches to skip
+	Offset int `json:"offset,omitempty"`
+
+	// Limit is the maximum number of matches to return, or zero for all
+	Limit int `json:"limit,omitempty"`
+}
+
 type SearchCriteria struct {
 	Hash     PHash `json:"hash"`
 	Distance uint  `json:"distance"`
+	SearchOptions
+
+	// Prefix, Tags, MinWidth, MinHeight and ExcludeLowInformation
+	// restrict the search to hashes with a record that matches all of them
+	// (see Filter)
+	Prefix                string   `json:"prefix,omitempty"`
+	Tags                  []string `json:"tags,omitempty"`
+	MinWidth              int      `json:"min_width,omitempty"`
+	MinHeight             int      `json:"min_height,omitempty"`
+	ExcludeLowInformation bool     `json:"exclude_low_information,omitempty"`
+}
+
+// Filter returns the Filter described by the criteria, or nil if the
+// criteria don't restrict the search
+func (criteria SearchCriteria) Filter() Filter {
+	var filters []Filter
+	if criteria.Prefix != "" {
+		filters = append(filters, FilterPrefix(criteria.Prefix))
+	}
+
+	if len(criteria.Tags) > 0 {
+		filters = append(filters, FilterTags(criteria.Tags...))
+	}
+
+	if criteria.MinWidth > 0 || criteria.MinHeight > 0 {
+		filters = append(filters, FilterMinSize(criteria.MinWidth, criteria.MinHeight))
+	}
+
+	if criteria.ExcludeLowInformation {
+		filters = append(filters, FilterInformative)
+	}
+
+	if len(filters) == 0 {
+		return nil
+	}
+	return FilterAll(filters...)
 }
 
 type ImageInfo struct {
-	Hash     PHash  `json:"hash"`
-	Location string `json:"location"`
+	// ID identifies the image for as long as it is in the database.  It is
+	// assigned when the image is first added, and kept when the record for
+	// its location is replaced
+	ID       uint64    `json:"id,omitempty"`
+	Hash     PHash     `json:"hash"`
+	Location string    `json:"location"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Checksum string    `json:"checksum"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Tags     []string  `json:"tags,omitempty"`
+
+	// LowInformation is set for images that are too uniform (such as
+	// blank or solid color images) for their hash to be meaningful
+	LowInformation bool `json:"low_information,omitempty"`
 }
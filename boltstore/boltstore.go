@@ -0,0 +1,187 @@
+// Package boltstore provides a disgo.RecordStore that keeps records on disk
+// in a bbolt database, so the number of records isn't limited by memory.
+// The index is still kept in memory and is rebuilt from the stored records
+// when the store is opened with disgo.NewDBWithStore, or when a saved
+// database is loaded.  The store is a disgo.PersistentStore, so saved
+// databases don't copy its records
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/abates/disgo"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// recordBucket maps each location to its JSON encoded record
+	recordBucket = []byte("records")
+
+	// hashBucket has a key for each record made of its hash (8 bytes, big
+	// endian) followed by its location, so the records for a hash can be
+	// found with a prefix scan
+	hashBucket = []byte("hashes")
+
+	// idBucket maps the ID (8 bytes, big endian) of each record that has
+	// one to its location
+	idBucket = []byte("ids")
+)
+
+// Store is a disgo.RecordStore backed by a bbolt database
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens (or creates) the bbolt database at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{recordBucket, hashBucket, idBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func idKey(id uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], id)
+	return key[:]
+}
+
+func hashKey(hash disgo.PHash, location string) []byte {
+	key := make([]byte, 8, 8+len(location))
+	binary.BigEndian.PutUint64(key, uint64(hash))
+	return append(key, location...)
+}
+
+func get(tx *bolt.Tx, location string) (info disgo.ImageInfo, err error) {
+	buf := tx.Bucket(recordBucket).Get([]byte(location))
+	if buf == nil {
+		return info, disgo.ErrNotFound
+	}
+	err = json.Unmarshal(buf, &info)
+	return info, err
+}
+
+func (s *Store) Get(location string) (info disgo.ImageInfo, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		info, err = get(tx, location)
+		return err
+	})
+	return info, err
+}
+
+func (s *Store) ID(id uint64) (info disgo.ImageInfo, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		location := tx.Bucket(idBucket).Get(idKey(id))
+		if location == nil || id == 0 {
+			return disgo.ErrNotFound
+		}
+		info, err = get(tx, string(location))
+		return err
+	})
+	return info, err
+}
+
+func (s *Store) Put(info disgo.ImageInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if previous, err := get(tx, info.Location); err == nil {
+			if err = remove(tx, previous); err != nil {
+				return err
+			}
+		}
+
+		err := tx.Bucket(recordBucket).Put([]byte(info.Location), buf)
+		if err == nil {
+			err = tx.Bucket(hashBucket).Put(hashKey(info.Hash, info.Location), nil)
+		}
+
+		if err == nil && info.ID != 0 {
+			err = tx.Bucket(idBucket).Put(idKey(info.ID), []byte(info.Location))
+		}
+		return err
+	})
+}
+
+func (s *Store) Delete(location string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		info, err := get(tx, location)
+		if err == nil {
+			err = tx.Bucket(recordBucket).Delete([]byte(location))
+		}
+
+		if err == nil {
+			err = remove(tx, info)
+		}
+		return err
+	})
+}
+
+// remove deletes the hash and ID keys of info
+func remove(tx *bolt.Tx, info disgo.ImageInfo) error {
+	err := tx.Bucket(hashBucket).Delete(hashKey(info.Hash, info.Location))
+	ids := tx.Bucket(idBucket)
+	if err == nil && info.ID != 0 && string(ids.Get(idKey(info.ID))) == info.Location {
+		err = ids.Delete(idKey(info.ID))
+	}
+	return err
+}
+
+// Hash returns the records with hash, sorted by location
+func (s *Store) Hash(hash disgo.PHash) (records []disgo.ImageInfo, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		prefix := hashKey(hash, "")
+		cursor := tx.Bucket(hashBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			info, err := get(tx, string(key[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			records = append(records, info)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Walk calls fn for the records in order of location
+func (s *Store) Walk(fn func(disgo.ImageInfo) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordBucket).ForEach(func(_, buf []byte) error {
+			var info disgo.ImageInfo
+			err := json.Unmarshal(buf, &info)
+			if err == nil {
+				err = fn(info)
+			}
+			return err
+		})
+	})
+}
+
+// Persistent returns true, the records are kept in the bbolt database
+func (s *Store) Persistent() bool { return true }
+
+// Close closes the bbolt database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,142 @@
+package boltstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/abates/disgo"
+)
+
+func TestStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "records.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	a := disgo.ImageInfo{Hash: 0x42, Location: "a.png", Size: 37}
+	b := disgo.ImageInfo{Hash: 0x42, Location: "b.png"}
+	c := disgo.ImageInfo{Hash: 0x43, Location: "c.png"}
+	for _, info := range []disgo.ImageInfo{a, b, {Hash: 0x01, Location: "c.png"}, c} {
+		if err := store.Put(info); err != nil {
+			t.Fatalf("Expected nil got %v", err)
+		}
+	}
+
+	if info, err := store.Get("a.png"); err != nil || !reflect.DeepEqual(info, a) {
+		t.Errorf("Expected %v got %v (%v)", a, info, err)
+	}
+
+	if _, err := store.Get("missing.png"); err != disgo.ErrNotFound {
+		t.Errorf("Expected %v got %v", disgo.ErrNotFound, err)
+	}
+
+	tests := []struct {
+		hash     disgo.PHash
+		expected []disgo.ImageInfo
+	}{
+		{0x42, []disgo.ImageInfo{a, b}},
+		{0x43, []disgo.ImageInfo{c}},
+		{0x01, nil},
+	}
+
+	for i, test := range tests {
+		records, err := store.Hash(test.hash)
+		if err != nil || !reflect.DeepEqual(test.expected, records) {
+			t.Errorf("tests[%d] expected %v got %v (%v)", i, test.expected, records, err)
+		}
+	}
+
+	d := disgo.ImageInfo{ID: 4, Hash: 0x44, Location: "d.png"}
+	store.Put(d)
+	if info, err := store.ID(4); err != nil || !reflect.DeepEqual(info, d) {
+		t.Errorf("Expected %v got %v (%v)", d, info, err)
+	}
+
+	store.Delete("d.png")
+	if _, err := store.ID(4); err != disgo.ErrNotFound {
+		t.Errorf("Expected %v got %v", disgo.ErrNotFound, err)
+	}
+
+	if err := store.Delete("b.png"); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+
+	if err := store.Delete("b.png"); err != disgo.ErrNotFound {
+		t.Errorf("Expected %v got %v", disgo.ErrNotFound, err)
+	}
+	store.Close()
+
+	// the index is rebuilt from the records when the store is reopened
+	store, _ = Open(path)
+	db, err := disgo.NewDBWithStore(disgo.NewRadixIndex(), store)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer db.Close()
+
+	if matches, _ := db.SearchByHash(0x43, 0); len(matches) != 1 {
+		t.Errorf("Expected 1 match got %v", matches)
+	}
+
+	if err := db.RemovePath("c.png"); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+
+	if matches, _ := db.SearchByHash(0x43, 0); len(matches) != 0 {
+		t.Errorf("Expected no matches got %v", matches)
+	}
+
+	var locations []string
+	store.Walk(func(info disgo.ImageInfo) error {
+		locations = append(locations, info.Location)
+		return nil
+	})
+
+	if !reflect.DeepEqual([]string{"a.png"}, locations) {
+		t.Errorf("Expected [a.png] got %v", locations)
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	store, _ := Open(filepath.Join(dir, "records.db"))
+	db, _ := disgo.NewDBWithStore(disgo.NewRadixIndex(), store)
+	defer db.Close()
+
+	db.Import(strings.NewReader(`{"hash":66,"location":"a.png"}`))
+	db.AddHash(0x43)
+
+	buf, err := db.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if bytes.Contains(buf, []byte("a.png")) {
+		t.Errorf("Expected the records to be left out of the snapshot")
+	}
+
+	if err := db.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	for _, hash := range []disgo.PHash{0x42, 0x43} {
+		if matches, _ := db.SearchByHash(hash, 0); len(matches) != 1 {
+			t.Errorf("Expected 1 match for %v got %v", hash, matches)
+		}
+	}
+
+	if info, err := store.Get("a.png"); err != nil || info.ID != 1 {
+		t.Errorf("Expected a.png to keep ID 1 got %v (%v)", info, err)
+	}
+}
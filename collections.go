@@ -0,0 +1,173 @@
+package disgo
+
+import (
+	"bytes"
+	"context"
+	"sort"
+)
+
+// Collection returns the named collection, creating an empty one with a
+// RadixIndex if there isn't one.  A collection is a DB of its own, with its
+// own index and records, that is saved and loaded along with db and
+// writes its changes to db's write-ahead log.  Creating a collection isn't
+// logged, replaying its first change creates it again, so a collection
+// that is still empty is only kept by the next checkpoint.  The empty name
+// refers to db itself
+func (db *DB) Collection(name string) *DB {
+	if name == "" {
+		return db
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.collection(name)
+}
+
+func (db *DB) collection(name string) *DB {
+	collection, found := db.collections[name]
+	if !found {
+		collection = New()
+		db.setCollection(name, collection)
+	}
+	return collection
+}
+
+// SetCollection adds collection to db under name, replacing any collection
+// already there.  This allows a collection to use a different index or
+// record store.  Its changes are written to db's write-ahead log from then
+// on, but the log can't hold its index or store, or what it held before:
+// those are only durable after the next checkpoint.  Until then, replaying
+// the log replaces the collection with an empty one from New and applies
+// the changes that followed
+func (db *DB) SetCollection(name string, collection *DB) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.setCollection(name, collection)
+	return db.log(walEntry{Op: walSetCollection, Name: name})
+}
+
+func (db *DB) setCollection(name string, collection *DB) {
+	if db.collections == nil {
+		db.collections = make(map[string]*DB)
+	}
+	db.collections[name] = collection
+
+	if db.wal != nil {
+		collection.mutex.Lock()
+		collection.setWAL(db.wal, append(db.walPath[:len(db.walPath):len(db.walPath)], name))
+		collection.mutex.Unlock()
+	}
+}
+
+// RemoveCollection removes the named collection from db
+func (db *DB) RemoveCollection(name string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, found := db.collections[name]; !found {
+		return ErrNotFound
+	}
+	return db.removeCollection(name)
+}
+
+func (db *DB) removeCollection(name string) error {
+	collection := db.collections[name]
+	delete(db.collections, name)
+	collection.mutex.Lock()
+	collection.setWAL(nil, nil)
+	collection.mutex.Unlock()
+	return db.log(walEntry{Op: walRemoveCollection, Name: name})
+}
+
+// Collections returns the names of db's collections in sorted order
+func (db *DB) Collections() []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	names := make([]string, 0, len(db.collections))
+	for name := range db.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SearchCollections searches each of the named collections (the empty name
+// is db itself) and returns the matches found in each.  Collections that
+// don't exist return ErrNotFound
+func (db *DB) SearchCollections(ctx context.Context, names []string, hash PHash, maxDistance int) (map[string][]PHash, error) {
+	results := make(map[string][]PHash)
+	for _, name := range names {
+		collection := db
+		if name != "" {
+			db.mutex.RLock()
+			found := false
+			collection, found = db.collections[name]
+			db.mutex.RUnlock()
+			if !found {
+				return nil, ErrNotFound
+			}
+		}
+
+		matches, err := collection.SearchByHashContext(ctx, hash, maxDistance)
+		if err != nil {
+			return nil, err
+		}
+		results[name] = matches
+	}
+	return results, nil
+}
+
+// marshalCollections encodes each collection as its name followed by the
+// collection saved with MarshalBinary
+func (db *DB) marshalCollections() ([]byte, error) {
+	writer := bytes.NewBuffer(nil)
+	names := make([]string, 0, len(db.collections))
+	for name := range db.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		buf, err := db.collections[name].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		writeSection(writer, []byte(name))
+		writeSection(writer, buf)
+	}
+	return writer.Bytes(), nil
+}
+
+// unmarshalCollections replaces db's collections with those in buf.
+// Collections that already exist are loaded in place, so they keep their
+// index and record store
+func (db *DB) unmarshalCollections(buf []byte) error {
+	collections := make(map[string]*DB)
+	for len(buf) > 0 {
+		var section []byte
+		name, remaining, err := readSection(buf)
+		if err == nil {
+			section, remaining, err = readSection(remaining)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		collection, found := db.collections[string(name)]
+		if !found {
+			collection = New()
+		}
+
+		if err = collection.UnmarshalBinary(section); err != nil {
+			return err
+		}
+		collections[string(name)] = collection
+		buf = remaining
+	}
+
+	db.collections = collections
+	if db.wal != nil {
+		db.setWAL(db.wal, db.walPath)
+	}
+	return nil
+}
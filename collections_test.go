@@ -0,0 +1,76 @@
+package disgo
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDBCollections(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "default.png"})
+	db.Collection("photos").addRecord(ImageInfo{Hash: 0x02, Location: "photo.png"})
+	db.Collection("scans").addRecord(ImageInfo{Hash: 0x03, Location: "scan.png"})
+	db.Collection("scans").Collection("old").AddHash(0x04)
+
+	if db.Collection("") != db {
+		t.Errorf("Expected the empty name to refer to the database")
+	}
+
+	if names := db.Collections(); !reflect.DeepEqual([]string{"photos", "scans"}, names) {
+		t.Errorf("Expected [photos scans] got %v", names)
+	}
+
+	tests := []struct {
+		names    []string
+		expected map[string][]PHash
+	}{
+		{[]string{""}, map[string][]PHash{"": {0x01}}},
+		{[]string{"photos"}, map[string][]PHash{"photos": {0x02}}},
+		{[]string{"", "scans"}, map[string][]PHash{"": {0x01}, "scans": {0x03}}},
+	}
+
+	for i, test := range tests {
+		results, err := db.SearchCollections(context.Background(), test.names, 0x00, 64)
+		if err != nil || !reflect.DeepEqual(test.expected, results) {
+			t.Errorf("tests[%d] expected %v got %v (%v)", i, test.expected, results, err)
+		}
+	}
+
+	if _, err := db.SearchCollections(context.Background(), []string{"missing"}, 0x00, 64); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := db.Save(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	// collections missing from the saved file are removed by Load
+	loaded := New()
+	loaded.Collection("stale")
+	if err := loaded.Load(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if names := loaded.Collections(); !reflect.DeepEqual([]string{"photos", "scans"}, names) {
+		t.Errorf("Expected [photos scans] got %v", names)
+	}
+
+	if !reflect.DeepEqual(testRecords(db.Collection("photos")), testRecords(loaded.Collection("photos"))) {
+		t.Errorf("Expected %v got %v", testRecords(db.Collection("photos")), testRecords(loaded.Collection("photos")))
+	}
+
+	if matches, _ := loaded.Collection("scans").Collection("old").SearchByHash(0x04, 0); len(matches) != 1 {
+		t.Errorf("Expected nested collection to be loaded got %v", matches)
+	}
+
+	if err := loaded.RemoveCollection("photos"); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+
+	if err := loaded.RemoveCollection("photos"); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+}
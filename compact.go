@@ -0,0 +1,383 @@
+package disgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrReadOnly = errors.New("Index is read only")
+
+// compactNodeSize is the size of a node in a CompactRadixIndex.  Each node
+// is laid out (little endian) as:
+//
+//	[0:8]   prefix
+//	[8:12]  index of the right child, zero if there is none; for leaves
+//	        the number of duplicates (see Node.duplicates)
+//	[12]    prefix length
+//	[13]    flags (see nodeFlags)
+//	[14:16] reserved
+//
+// Nodes are stored in depth first order, so a node's left child (if it
+// has one) always immediately follows it
+const compactNodeSize = 16
+
+// CompactRadixIndex is a read-only radix tree whose nodes are packed into
+// a single contiguous buffer and refer to each other by index rather than
+// by pointer.  It uses about a third of the memory of a RadixIndex (see
+// BenchmarkCompactRadixIndexMemory) and, since
+// the buffer contains no pointers, adds nothing for the garbage collector
+// to scan.  A CompactRadixIndex is created from a RadixIndex with Compact,
+// or by loading a saved RadixIndex with UnmarshalBinary
+type CompactRadixIndex struct {
+	nodes []byte
+}
+
+func NewCompactRadixIndex() *CompactRadixIndex {
+	ci := &CompactRadixIndex{}
+	ci.nodes = make([]byte, compactNodeSize)
+	return ci
+}
+
+// Compact copies the index into a CompactRadixIndex
+func (ri *RadixIndex) Compact() *CompactRadixIndex {
+	ci := &CompactRadixIndex{}
+	if root, ok := ri.root.(*Node); ok {
+		ci.appendNode(root)
+	}
+	return ci
+}
+
+// Compact returns the index itself
+func (ci *CompactRadixIndex) Compact() *CompactRadixIndex { return ci }
+
+func (ci *CompactRadixIndex) appendNode(n *Node) {
+	i := ci.add(n.prefix, n.length, n.left != nil, n.right != nil, n.duplicates)
+	if n.left != nil {
+		ci.appendNode(n.left)
+	}
+
+	if n.right != nil {
+		ci.setRight(i, ci.count())
+		ci.appendNode(n.right)
+	}
+}
+
+// add appends a node to the buffer and returns its index
+func (ci *CompactRadixIndex) add(prefix PHash, length uint8, hasLeft, hasRight bool, duplicates uint32) int32 {
+	var buf [compactNodeSize]byte
+	flags := nodeFlags(0x00)
+	if hasLeft {
+		flags.setHasLeft()
+	}
+
+	if hasRight {
+		flags.setHasRight()
+	}
+
+	if duplicates > 0 {
+		flags.setHasDuplicates()
+		binary.LittleEndian.PutUint32(buf[8:], duplicates)
+	}
+
+	binary.LittleEndian.PutUint64(buf[0:], uint64(prefix))
+	buf[12] = length
+	buf[13] = byte(flags)
+	ci.nodes = append(ci.nodes, buf[:]...)
+	return ci.count() - 1
+}
+
+func (ci *CompactRadixIndex) count() int32 { return int32(len(ci.nodes) / compactNodeSize) }
+
+func (ci *CompactRadixIndex) node(i int32) []byte {
+	offset := int(i) * compactNodeSize
+	return ci.nodes[offset : offset+compactNodeSize]
+}
+
+func (ci *CompactRadixIndex) prefix(i int32) PHash {
+	return PHash(binary.LittleEndian.Uint64(ci.node(i)))
+}
+
+func (ci *CompactRadixIndex) length(i int32) uint8 { return ci.node(i)[12] }
+
+func (ci *CompactRadixIndex) flags(i int32) nodeFlags { return nodeFlags(ci.node(i)[13]) }
+
+func (ci *CompactRadixIndex) right(i int32) int32 {
+	return int32(binary.LittleEndian.Uint32(ci.node(i)[8:]))
+}
+
+func (ci *CompactRadixIndex) duplicates(i int32) uint32 {
+	if ci.flags(i).HasDuplicates() {
+		return binary.LittleEndian.Uint32(ci.node(i)[8:])
+	}
+	return 0
+}
+
+func (ci *CompactRadixIndex) setRight(i, right int32) {
+	binary.LittleEndian.PutUint32(ci.node(i)[8:], uint32(right))
+}
+
+// validate checks that the nodes form a tree laid out the way Compact lays
+// it out, so that searches can't index outside the buffer or loop.  It
+// returns ErrCorrupt if they don't
+func (ci *CompactRadixIndex) validate() error {
+	if ci.count() == 0 {
+		return nil
+	}
+
+	next, err := ci.validateNode(0, 0)
+	if err == nil && next != ci.count() {
+		err = ErrCorrupt
+	}
+	return err
+}
+
+// validateNode validates the subtree at node i, which starts depth bits
+// into the hash, and returns the index of the node that follows it
+func (ci *CompactRadixIndex) validateNode(i int32, depth int) (int32, error) {
+	if i >= ci.count() {
+		return 0, ErrCorrupt
+	}
+
+	flags, length := ci.flags(i), int(ci.length(i))
+	leaf := !flags.HasLeft() && !flags.HasRight()
+	depth += length
+	switch {
+	case flags&0x1f != 0 || depth > 64:
+		return 0, ErrCorrupt
+	case i > 0 && length == 0:
+		return 0, ErrCorrupt
+	case leaf && depth < 64 && (i > 0 || length > 0 || ci.count() > 1):
+		// only an empty root is a leaf before the last bit
+		return 0, ErrCorrupt
+	case !leaf && (depth == 64 || flags.HasDuplicates()):
+		return 0, ErrCorrupt
+	}
+
+	next := i + 1
+	var err error
+	if flags.HasLeft() {
+		next, err = ci.validateNode(next, depth)
+	}
+
+	if err == nil && flags.HasRight() {
+		if ci.right(i) != next {
+			return 0, ErrCorrupt
+		}
+		next, err = ci.validateNode(next, depth)
+	}
+	return next, err
+}
+
+func (ci *CompactRadixIndex) Insert(PHash) error { return ErrReadOnly }
+
+func (ci *CompactRadixIndex) Remove(PHash) error { return ErrReadOnly }
+
+func (ci *CompactRadixIndex) Search(hash PHash, distance int) ([]PHash, error) {
+	return ci.SearchContext(context.Background(), hash, distance)
+}
+
+func (ci *CompactRadixIndex) SearchContext(ctx context.Context, hash PHash, distance int) ([]PHash, error) {
+	matches, err := ci.AppendSearchContext(ctx, nil, hash, distance)
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// AppendSearch appends each hash within distance of hash to dst and returns
+// the extended slice
+func (ci *CompactRadixIndex) AppendSearch(dst []PHash, hash PHash, distance int) ([]PHash, error) {
+	return ci.AppendSearchContext(context.Background(), dst, hash, distance)
+}
+
+func (ci *CompactRadixIndex) AppendSearchContext(ctx context.Context, dst []PHash, hash PHash, distance int) ([]PHash, error) {
+	var it compactIterator
+	it.reset(ctx, ci, hash, distance)
+	for m, ok := it.next(); ok; m, ok = it.next() {
+		dst = append(dst, m.Hash)
+	}
+	return dst, it.err
+}
+
+// SearchFunc calls fn for each hash within distance of hash, in ascending
+// order, until fn returns false
+func (ci *CompactRadixIndex) SearchFunc(hash PHash, distance int, fn func(Match) bool) error {
+	return ci.SearchFuncContext(context.Background(), hash, distance, fn)
+}
+
+func (ci *CompactRadixIndex) SearchFuncContext(ctx context.Context, hash PHash, distance int, fn func(Match) bool) error {
+	var it compactIterator
+	it.reset(ctx, ci, hash, distance)
+	for m, ok := it.next(); ok && fn(m); m, ok = it.next() {
+	}
+	return it.err
+}
+
+type compactFrame struct {
+	node     int32
+	search   PHash
+	match    PHash
+	distance int
+}
+
+// compactIterator is the CompactRadixIndex equivalent of radixIterator
+type compactIterator struct {
+	searchContext
+	index    *CompactRadixIndex
+	top      int
+	frames   [maxSearchDepth]compactFrame
+	overflow []compactFrame
+}
+
+func (it *compactIterator) reset(ctx context.Context, index *CompactRadixIndex, search PHash, distance int) {
+	it.searchContext = searchContext{ctx: ctx, maxDistance: distance}
+	it.index = index
+	it.top = 0
+	it.overflow = it.overflow[:0]
+	if index.count() > 0 {
+		it.push(compactFrame{0, search, 0x00, distance})
+	}
+}
+
+func (it *compactIterator) push(frame compactFrame) {
+	if it.top < len(it.frames) {
+		it.frames[it.top] = frame
+		it.top++
+	} else {
+		it.overflow = append(it.overflow, frame)
+	}
+}
+
+func (it *compactIterator) pop() (frame compactFrame, ok bool) {
+	if len(it.overflow) > 0 {
+		frame = it.overflow[len(it.overflow)-1]
+		it.overflow = it.overflow[:len(it.overflow)-1]
+		return frame, true
+	} else if it.top > 0 {
+		it.top--
+		return it.frames[it.top], true
+	}
+	return frame, false
+}
+
+func (it *compactIterator) next() (Match, bool) {
+	for frame, ok := it.pop(); ok; frame, ok = it.pop() {
+		if it.cancelled() {
+			return Match{}, false
+		}
+
+		length := it.index.length(frame.node)
+		flags := it.index.flags(frame.node)
+		if length > 0 {
+			prefix := it.index.prefix(frame.node)
+			frame.match = frame.match<<length | prefix>>(64-length)
+			frame.distance -= prefix.Distance(frame.search & bitmasks[length])
+			frame.search = frame.search << length
+		}
+
+		if frame.distance < 0 {
+			continue
+		}
+
+		if length > 0 && !flags.HasLeft() && !flags.HasRight() {
+			return Match{Hash: frame.match, Distance: it.maxDistance - frame.distance, Count: int(it.index.duplicates(frame.node)) + 1}, true
+		}
+
+		if flags.HasRight() {
+			it.push(compactFrame{it.index.right(frame.node), frame.search, frame.match, frame.distance})
+		}
+
+		if flags.HasLeft() {
+			it.push(compactFrame{frame.node + 1, frame.search, frame.match, frame.distance})
+		}
+	}
+	return Match{}, false
+}
+
+// MarshalBinary encodes the index in the same format as RadixIndex
+func (ci *CompactRadixIndex) MarshalBinary() ([]byte, error) {
+	writer := bytes.NewBuffer(nil)
+	if ci.count() > 0 {
+		ci.encode(writer, 0)
+	}
+	return writer.Bytes(), nil
+}
+
+// encode writes the subtree at node i and returns the index of the node
+// that follows it
+func (ci *CompactRadixIndex) encode(writer io.Writer, i int32) int32 {
+	var buf [10]byte
+	flags := ci.flags(i)
+	buf[0] = byte(flags)
+	buf[1] = ci.length(i)
+	binary.BigEndian.PutUint64(buf[2:], uint64(ci.prefix(i)))
+	writer.Write(buf[:])
+	if flags.HasDuplicates() {
+		binary.BigEndian.PutUint32(buf[:], ci.duplicates(i))
+		writer.Write(buf[:4])
+	}
+
+	next := i + 1
+	if flags.HasLeft() {
+		next = ci.encode(writer, next)
+	}
+
+	if flags.HasRight() {
+		next = ci.encode(writer, ci.right(i))
+	}
+	return next
+}
+
+// UnmarshalBinary decodes an index saved by RadixIndex or
+// CompactRadixIndex directly into the compact layout.  It returns
+// ErrCorrupt, and leaves the index empty, if buf isn't a valid tree
+func (ci *CompactRadixIndex) UnmarshalBinary(buf []byte) error {
+	ci.nodes = make([]byte, 0, len(buf)/10*compactNodeSize)
+	remaining, err := ci.decode(buf)
+	if err == nil && len(remaining) > 0 {
+		err = ErrCorrupt
+	}
+
+	if err == nil {
+		err = ci.validate()
+	}
+
+	if err != nil {
+		ci.nodes = make([]byte, compactNodeSize)
+	}
+	return err
+}
+
+func (ci *CompactRadixIndex) decode(buf []byte) ([]byte, error) {
+	if len(buf) < 10 {
+		return nil, ErrCorrupt
+	}
+
+	flags := nodeFlags(buf[0])
+	prefix, length := PHash(binary.BigEndian.Uint64(buf[2:])), buf[1]
+	buf = buf[10:]
+
+	var duplicates uint32
+	if flags.HasDuplicates() {
+		if len(buf) < 4 {
+			return nil, ErrCorrupt
+		}
+		duplicates = binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+	}
+	i := ci.add(prefix, length, flags.HasLeft(), flags.HasRight(), duplicates)
+
+	var err error
+	if flags.HasLeft() {
+		buf, err = ci.decode(buf)
+	}
+
+	if err == nil && flags.HasRight() {
+		ci.setRight(i, ci.count())
+		buf, err = ci.decode(buf)
+	}
+	return buf, err
+}
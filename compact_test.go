@@ -0,0 +1,150 @@
+package disgo
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newTestRadixIndex(n int) *RadixIndex {
+	index := NewRadixIndex()
+	for _, hash := range benchmarkHashes(n) {
+		index.Insert(hash)
+	}
+	return index
+}
+
+func TestCompactRadixIndexSearch(t *testing.T) {
+	index := newTestRadixIndex(1000)
+	compact := index.Compact()
+
+	rng := rand.New(rand.NewSource(1))
+	queries := append(benchmarkHashes(1000)[:50], PHash(rng.Uint64()), PHash(rng.Uint64()))
+	for _, query := range queries {
+		for _, distance := range []int{0, 3, 12} {
+			expected, _ := index.Search(query, distance)
+			matches, _ := compact.Search(query, distance)
+			if !reflect.DeepEqual(expected, matches) {
+				t.Errorf("%v at %d expected %v got %v", query, distance, expected, matches)
+			}
+		}
+	}
+
+	var found []Match
+	compact.SearchFunc(queries[0], 64, func(match Match) bool {
+		found = append(found, match)
+		return len(found) < 3
+	})
+
+	if len(found) != 3 || found[0].Distance != found[0].Hash.Distance(queries[0]) {
+		t.Errorf("Expected 3 matches with distances got %v", found)
+	}
+
+	if matches, _ := NewCompactRadixIndex().Search(0, 64); len(matches) != 0 {
+		t.Errorf("Expected no matches got %v", matches)
+	}
+}
+
+func TestCompactRadixIndexReadOnly(t *testing.T) {
+	compact := NewCompactRadixIndex()
+	if err := compact.Insert(0x42); err != ErrReadOnly {
+		t.Errorf("Expected %v got %v", ErrReadOnly, err)
+	}
+
+	if err := compact.Remove(0x42); err != ErrReadOnly {
+		t.Errorf("Expected %v got %v", ErrReadOnly, err)
+	}
+}
+
+func TestCompactRadixIndexMarshalBinary(t *testing.T) {
+	index := newTestRadixIndex(1000)
+	index.Insert(benchmarkHashes(1)[0])
+	expected, _ := index.MarshalBinary()
+	buf, _ := index.Compact().MarshalBinary()
+	if !bytes.Equal(expected, buf) {
+		t.Errorf("Expected compact encoding to match the radix index encoding")
+	}
+
+	compact := NewCompactRadixIndex()
+	if err := compact.UnmarshalBinary(expected); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if !bytes.Equal(index.Compact().nodes, compact.nodes) {
+		t.Errorf("Expected decoded nodes to match compacted nodes")
+	}
+
+	tests := [][]byte{
+		expected[:len(expected)-1],
+		append(append([]byte(nil), expected...), 0x00),
+		// a single node whose prefix is longer than a hash
+		{0x00, 200, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+
+	for i, test := range tests {
+		if err := compact.UnmarshalBinary(test); err != ErrCorrupt {
+			t.Errorf("tests[%d] expected %v got %v", i, ErrCorrupt, err)
+		}
+
+		if matches, err := compact.Search(0, 64); err != nil || len(matches) != 0 {
+			t.Errorf("tests[%d] expected an empty index got %v (%v)", i, matches, err)
+		}
+	}
+}
+
+func TestCompactRadixIndexAppendSearch(t *testing.T) {
+	compact := newTestRadixIndex(1000).Compact()
+	buf := make([]PHash, 0, 1000)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = compact.AppendSearch(buf[:0], 0x37, 12)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected no allocations got %v", allocs)
+	}
+}
+
+// benchmarkMemory reports the heap used per hash by the index that build
+// returns, and how long a full garbage collection takes while it is live
+func benchmarkMemory(b *testing.B, build func([]PHash) Index) {
+	hashes := benchmarkHashes(1000000)
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		index := build(hashes)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+
+		start := time.Now()
+		runtime.GC()
+		elapsed := time.Since(start)
+		runtime.KeepAlive(index)
+
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(hashes)), "bytes/hash")
+		b.ReportMetric(float64(elapsed.Microseconds()), "gc-µs")
+	}
+}
+
+func BenchmarkRadixIndexMemory(b *testing.B) {
+	benchmarkMemory(b, func(hashes []PHash) Index {
+		index := NewRadixIndex()
+		for _, hash := range hashes {
+			index.Insert(hash)
+		}
+		return index
+	})
+}
+
+func BenchmarkCompactRadixIndexMemory(b *testing.B) {
+	benchmarkMemory(b, func(hashes []PHash) Index {
+		index := NewRadixIndex()
+		for _, hash := range hashes {
+			index.Insert(hash)
+		}
+		return index.Compact()
+	})
+}
@@ -1,11 +1,17 @@
 package disgo
 
 import (
+	"bytes"
+	"context"
 	"encoding"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"hash/crc32"
 	"image"
 	"io"
 	"io/ioutil"
+	"sync"
 
 	"github.com/disintegration/imaging"
 )
@@ -13,16 +19,73 @@ import (
 var (
 	ErrNotFound     = errors.New("Image not found")
 	ErrNotSupported = errors.New("Underlying index does not support loading or saving")
+	ErrCorrupt      = errors.New("Database file is corrupt")
 )
 
+// dbMagic prefixes saved databases.  It is followed by the index, records,
+// collections and snapshotMeta sections, then a section holding the CRC-32
+// of everything before it.  Files without it are assumed to be a bare
+// index saved by an earlier version
+var dbMagic = []byte("disgo\x00\x01")
+
+// snapshotMeta is the JSON encoded section that describes the rest of a
+// saved database
+type snapshotMeta struct {
+	// Persistent is set when the records were left out because the record
+	// store is a PersistentStore.  Hashes then lists the hashes in the
+	// index that don't belong to a record, once for each time they were
+	// added
+	Persistent bool    `json:"persistent,omitempty"`
+	Hashes     []PHash `json:"hashes,omitempty"`
+
+	// Sequence is the sequence number of the last write-ahead log entry
+	// included in the snapshot.  Replaying the log skips entries up to it
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Match is a hash found by a search and its distance from the search hash
+type Match struct {
+	Hash     PHash `json:"hash"`
+	Distance int   `json:"distance"`
+
+	// Count is the number of times the hash was inserted into the index
+	Count int `json:"count"`
+
+	// IDs are the images with the hash, when the index is a PostingIndex
+	IDs []uint64 `json:"ids,omitempty"`
+}
+
 type Index interface {
 	Insert(PHash) error
+	Remove(PHash) error
 	Search(PHash, int) ([]PHash, error)
+	SearchContext(context.Context, PHash, int) ([]PHash, error)
+	SearchFunc(PHash, int, func(Match) bool) error
+	SearchFuncContext(context.Context, PHash, int, func(Match) bool) error
 }
 
 type DB struct {
-	index  Index
-	hasher func(image.Image) (PHash, error)
+	mutex   sync.RWMutex
+	index   Index
+	records RecordStore
+	hasher  func(image.Image) (PHash, error)
+	wal     *wal
+
+	// walPath is the names of the collections leading to the database when
+	// it is a collection writing to its parent's log, and empty when the
+	// log is its own
+	walPath []string
+
+	// nextID is the last ID given to a record
+	nextID uint64
+
+	// seq is the sequence number of the last write-ahead log entry the
+	// database includes
+	seq uint64
+
+	collections map[string]*DB
 }
 
 func New() *DB {
@@ -31,12 +94,22 @@ func New() *DB {
 
 func NewDB(index Index) *DB {
 	r := &DB{
-		index:  index,
-		hasher: Hash,
+		index:   index,
+		records: NewMemoryStore(),
+		hasher:  Hash,
 	}
 	return r
 }
 
+// NewDBWithStore creates a DB that keeps its records in store.  The hashes
+// of the records already in store are added to index, and records without
+// an ID are given one
+func NewDBWithStore(index Index, store RecordStore) (*DB, error) {
+	db := NewDB(index)
+	db.records = store
+	return db, db.indexRecords(false)
+}
+
 func (db *DB) Add(img image.Image) (PHash, error) {
 	hash, err := db.hasher(img)
 	if err == nil {
@@ -45,8 +118,36 @@ func (db *DB) Add(img image.Image) (PHash, error) {
 	return hash, err
 }
 
+// contextReader fails reads once its context is done, which aborts any
+// image decoding in progress
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(p)
+}
+
+func decode(ctx context.Context, reader io.Reader) (image.Image, error) {
+	img, err := imaging.Decode(&contextReader{ctx, reader})
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return img, err
+}
+
 func (db *DB) AddFile(reader io.Reader) (hash PHash, err error) {
-	img, err := imaging.Decode(reader)
+	return db.AddFileContext(context.Background(), reader)
+}
+
+// AddFileContext is like AddFile, but stops decoding the image if ctx is
+// cancelled
+func (db *DB) AddFileContext(ctx context.Context, reader io.Reader) (hash PHash, err error) {
+	img, err := decode(ctx, reader)
 	if err == nil {
 		hash, err = db.Add(img)
 	}
@@ -54,8 +155,44 @@ func (db *DB) AddFile(reader io.Reader) (hash PHash, err error) {
 }
 
 func (db *DB) AddHash(hash PHash) error {
-	db.index.Insert(hash)
-	return nil
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err := db.index.Insert(hash)
+	if err == nil {
+		err = db.log(walEntry{Op: walInsert, Hashes: []PHash{hash}})
+	}
+	return err
+}
+
+// batchInserter is implemented by indexes that can insert many hashes
+// faster than inserting them one at a time
+type batchInserter interface {
+	InsertBatch([]PHash) error
+}
+
+// AddHashes adds all of the hashes to the index, in a single batch if the
+// index supports it
+func (db *DB) AddHashes(hashes []PHash) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err := db.insert(hashes)
+	if err == nil {
+		err = db.log(walEntry{Op: walInsert, Hashes: hashes})
+	}
+	return err
+}
+
+func (db *DB) insert(hashes []PHash) (err error) {
+	if inserter, ok := db.index.(batchInserter); ok {
+		return inserter.InsertBatch(hashes)
+	}
+
+	for _, hash := range hashes {
+		if err = db.index.Insert(hash); err != nil {
+			break
+		}
+	}
+	return err
 }
 
 func (db *DB) Save(writer io.Writer) error {
@@ -67,10 +204,83 @@ func (db *DB) Save(writer io.Writer) error {
 }
 
 func (db *DB) MarshalBinary() ([]byte, error) {
-	if marshaler, ok := db.index.(encoding.BinaryMarshaler); ok {
-		return marshaler.MarshalBinary()
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.marshalBinary()
+}
+
+func (db *DB) marshalBinary() ([]byte, error) {
+	marshaler, ok := db.index.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	index, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := snapshotMeta{Sequence: db.seq}
+	var recordBuf []byte
+	if persistent(db.records) {
+		meta.Persistent = true
+		meta.Hashes, err = db.unrecordedHashes()
+	} else {
+		recordBuf, err = db.marshalRecords()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	collections, err := db.marshalCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	metaBuf, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bytes.NewBuffer(nil)
+	writer.Write(dbMagic)
+	writeSection(writer, index)
+	writeSection(writer, recordBuf)
+	writeSection(writer, collections)
+	writeSection(writer, metaBuf)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(writer.Bytes(), crcTable))
+	writeSection(writer, sum[:])
+	return writer.Bytes(), nil
+}
+
+// unrecordedHashes returns the hashes in the index that don't belong to a
+// record, such as those added with AddHash, once for each time they were
+// added
+func (db *DB) unrecordedHashes() ([]PHash, error) {
+	_, postings := db.index.(PostingIndex)
+	var hashes []PHash
+	var err error
+	walkErr := db.walk(func(match Match) bool {
+		recorded := len(match.IDs)
+		if !postings {
+			var infos []ImageInfo
+			infos, err = db.records.Hash(match.Hash)
+			recorded = len(infos)
+		}
+
+		for i := recorded; i < match.Count; i++ {
+			hashes = append(hashes, match.Hash)
+		}
+		return err == nil
+	})
+
+	if err == nil {
+		err = walkErr
 	}
-	return nil, ErrNotSupported
+	return hashes, err
 }
 
 func (db *DB) Load(reader io.Reader) error {
@@ -81,29 +291,394 @@ func (db *DB) Load(reader io.Reader) error {
 	return err
 }
 
+// UnmarshalBinary replaces the contents of the database with buf.  If the
+// database has a write-ahead log of its own (see OpenWAL) it is replayed
+// afterwards
 func (db *DB) UnmarshalBinary(buf []byte) error {
-	if unmarshaler, ok := db.index.(encoding.BinaryUnmarshaler); ok {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err := db.unmarshalBinary(buf)
+	if err == nil && db.wal != nil && len(db.walPath) == 0 {
+		err = db.replay()
+	}
+	return err
+}
+
+func (db *DB) unmarshalBinary(buf []byte) error {
+	unmarshaler, ok := db.index.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	if !bytes.HasPrefix(buf, dbMagic) {
 		return unmarshaler.UnmarshalBinary(buf)
 	}
-	return ErrNotSupported
+
+	index, remaining, err := readSection(buf[len(dbMagic):])
+	if err != nil {
+		return err
+	}
+
+	recordBuf, remaining, err := readSection(remaining)
+	if err != nil {
+		return err
+	}
+
+	collections, remaining, err := readSection(remaining)
+	if err != nil {
+		return err
+	}
+
+	var meta snapshotMeta
+	metaBuf, remaining, err := readSection(remaining)
+	if err == nil && json.Unmarshal(metaBuf, &meta) != nil {
+		err = ErrCorrupt
+	}
+
+	if err != nil {
+		return err
+	}
+
+	sum, _, err := readSection(remaining)
+	if err != nil {
+		return err
+	}
+
+	expected := crc32.Checksum(buf[:len(buf)-len(remaining)], crcTable)
+	if len(sum) != 4 || binary.BigEndian.Uint32(sum) != expected {
+		return ErrCorrupt
+	}
+
+	err = unmarshaler.UnmarshalBinary(index)
+	switch {
+	case err != nil:
+	case persistent(db.records):
+		// the store already has its records, so only the hashes that don't
+		// belong to one are kept from the saved index
+		err = db.keepUnrecorded(meta, recordBuf)
+		if err == nil {
+			err = db.indexRecords(false)
+		}
+	case meta.Persistent:
+		// the records weren't saved, so their hashes are left without one
+		err = db.unmarshalRecords(nil)
+		if err == nil {
+			err = db.indexRecords(true)
+		}
+	default:
+		err = db.unmarshalRecords(recordBuf)
+		if err == nil {
+			err = db.indexRecords(true)
+		}
+	}
+
+	if err == nil {
+		db.seq = meta.Sequence
+		err = db.unmarshalCollections(collections)
+	}
+	return err
+}
+
+// keepUnrecorded removes the hashes of the saved records from a freshly
+// loaded index, leaving those that don't belong to a record.  Snapshots of
+// a PersistentStore list the hashes to keep, other snapshots have records
+// whose hashes are removed
+func (db *DB) keepUnrecorded(meta snapshotMeta, recordBuf []byte) error {
+	counts := make(map[PHash]int)
+	if meta.Persistent {
+		for _, hash := range meta.Hashes {
+			counts[hash]++
+		}
+	} else if len(recordBuf) > 0 {
+		var records []struct {
+			Hash PHash `json:"hash"`
+		}
+
+		if err := json.Unmarshal(recordBuf, &records); err != nil {
+			return err
+		}
+
+		for _, info := range records {
+			counts[info.Hash]++
+		}
+	}
+
+	type removal struct {
+		hash  PHash
+		count int
+	}
+
+	var removals []removal
+	err := db.walk(func(match Match) bool {
+		count := counts[match.Hash]
+		if meta.Persistent {
+			count = match.Count - count
+		}
+
+		if count > match.Count {
+			count = match.Count
+		}
+
+		if count > 0 {
+			removals = append(removals, removal{match.Hash, count})
+		}
+		return true
+	})
+
+	for _, r := range removals {
+		for i := 0; i < r.count && err == nil; i++ {
+			err = db.index.Remove(r.hash)
+		}
+	}
+	return err
+}
+
+// indexRecords gives an ID to each record that doesn't have one and, unless
+// found is set because the index already holds each record's hash, adds
+// the records' hashes to the index.  PostingIndexes get every record's ID.
+// The records are streamed from the store; only those that need an ID are
+// held until the walk is over
+func (db *DB) indexRecords(found bool) error {
+	postings, ok := db.index.(PostingIndex)
+	var hashes []PHash
+	index := func(info ImageInfo) (err error) {
+		switch {
+		case ok && found:
+			// swap the occurrence already in the index for one with the ID
+			if err = db.index.Remove(info.Hash); err == nil || err == ErrNotFound {
+				err = postings.InsertID(info.Hash, info.ID)
+			}
+		case ok:
+			err = postings.InsertID(info.Hash, info.ID)
+		case !found:
+			hashes = append(hashes, info.Hash)
+		}
+		return err
+	}
+
+	db.nextID = 0
+	var unnumbered []ImageInfo
+	err := db.records.Walk(func(info ImageInfo) error {
+		if info.ID == 0 {
+			unnumbered = append(unnumbered, info)
+			return nil
+		}
+
+		if info.ID > db.nextID {
+			db.nextID = info.ID
+		}
+		return index(info)
+	})
+
+	for _, info := range unnumbered {
+		if err != nil {
+			break
+		}
+
+		db.nextID++
+		info.ID = db.nextID
+		if err = db.records.Put(info); err == nil {
+			err = index(info)
+		}
+	}
+
+	if err == nil {
+		err = db.insert(hashes)
+	}
+	return err
+}
+
+// marshalRecords encodes the records as a JSON array
+func (db *DB) marshalRecords() ([]byte, error) {
+	buf := bytes.NewBufferString("[")
+	err := db.records.Walk(func(info ImageInfo) error {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+
+		encoded, err := json.Marshal(info)
+		buf.Write(encoded)
+		return err
+	})
+	buf.WriteByte(']')
+	return buf.Bytes(), err
+}
+
+// unmarshalRecords replaces every record in the store with those in buf,
+// which may be empty
+func (db *DB) unmarshalRecords(buf []byte) error {
+	var records []ImageInfo
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &records); err != nil {
+			return err
+		}
+	}
+
+	var previous []string
+	err := db.records.Walk(func(info ImageInfo) error {
+		previous = append(previous, info.Location)
+		return nil
+	})
+
+	for _, location := range previous {
+		if err == nil {
+			err = db.records.Delete(location)
+		}
+	}
+
+	for _, info := range records {
+		if err == nil {
+			err = db.records.Put(info)
+		}
+	}
+	return err
+}
+
+// Close closes the write-ahead log, if there is one, and releases any
+// resources held by the index and record store, such as a memory mapped
+// file or an open database.  Collections are closed too
+func (db *DB) Close() (err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.wal != nil && len(db.walPath) == 0 {
+		err = db.wal.file.Close()
+	}
+	db.setWAL(nil, nil)
+
+	closers := []interface{}{db.index, db.records}
+	for _, collection := range db.collections {
+		closers = append(closers, collection)
+	}
+
+	for _, v := range closers {
+		if closer, ok := v.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+func writeSection(writer *bytes.Buffer, section []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(section)))
+	writer.Write(length[:])
+	writer.Write(section)
+}
+
+func readSection(buf []byte) (section []byte, remaining []byte, err error) {
+	if len(buf) < 8 {
+		return nil, nil, ErrCorrupt
+	}
+
+	length := binary.BigEndian.Uint64(buf)
+	buf = buf[8:]
+	if uint64(len(buf)) < length {
+		return nil, nil, ErrCorrupt
+	}
+	return buf[:length], buf[length:], nil
 }
 
 func (db *DB) Search(img image.Image, maxDistance int) (matches []PHash, err error) {
+	return db.SearchContext(context.Background(), img, maxDistance)
+}
+
+func (db *DB) SearchContext(ctx context.Context, img image.Image, maxDistance int) (matches []PHash, err error) {
 	hash, err := db.hasher(img)
 	if err == nil {
-		matches, err = db.SearchByHash(hash, maxDistance)
+		matches, err = db.SearchByHashContext(ctx, hash, maxDistance)
 	}
 	return matches, err
 }
 
 func (db *DB) SearchByFile(reader io.Reader, maxDistance int) (matches []PHash, err error) {
-	img, err := imaging.Decode(reader)
+	return db.SearchByFileContext(context.Background(), reader, maxDistance)
+}
+
+// SearchByFileContext is like SearchByFile, but stops decoding the image or
+// searching the index if ctx is cancelled
+func (db *DB) SearchByFileContext(ctx context.Context, reader io.Reader, maxDistance int) (matches []PHash, err error) {
+	img, err := decode(ctx, reader)
 	if err == nil {
-		matches, err = db.Search(img, maxDistance)
+		matches, err = db.SearchContext(ctx, img, maxDistance)
 	}
 	return matches, err
 }
 
 func (db *DB) SearchByHash(hash PHash, maxDistance int) ([]PHash, error) {
-	return db.index.Search(hash, maxDistance)
+	return db.SearchByHashContext(context.Background(), hash, maxDistance)
+}
+
+func (db *DB) SearchByHashContext(ctx context.Context, hash PHash, maxDistance int) ([]PHash, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.index.SearchContext(ctx, hash, maxDistance)
+}
+
+// SearchFunc calls fn with each match within maxDistance of hash until fn
+// returns false.  Matches are streamed from the index without collecting
+// them first.  The database is locked for reading until SearchFunc returns,
+// so fn must not modify it
+func (db *DB) SearchFunc(hash PHash, maxDistance int, fn func(Match) bool) error {
+	return db.SearchFuncContext(context.Background(), hash, maxDistance, fn)
+}
+
+func (db *DB) SearchFuncContext(ctx context.Context, hash PHash, maxDistance int, fn func(Match) bool) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.index.SearchFuncContext(ctx, hash, maxDistance, fn)
+}
+
+// SearchIDs returns the IDs of the images whose hashes are within
+// maxDistance of hash.  Hashes added without a record have no ID
+func (db *DB) SearchIDs(ctx context.Context, hash PHash, maxDistance int) ([]uint64, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	_, postings := db.index.(PostingIndex)
+	var ids []uint64
+	var err error
+	searchErr := db.index.SearchFuncContext(ctx, hash, maxDistance, func(match Match) bool {
+		if postings {
+			ids = append(ids, match.IDs...)
+			return true
+		}
+
+		var infos []ImageInfo
+		infos, err = db.records.Hash(match.Hash)
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+		}
+		return err == nil
+	})
+
+	if err == nil {
+		err = searchErr
+	}
+	return ids, err
+}
+
+// SearchByCriteria returns the page of matches selected by the criteria's
+// SearchOptions.  Matches rejected by the criteria's filter don't count
+// towards the page, and the search stops as soon as the page is full
+func (db *DB) SearchByCriteria(ctx context.Context, criteria SearchCriteria) ([]Match, error) {
+	var matches []Match
+	skip := criteria.Offset
+	fn := func(match Match) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		matches = append(matches, match)
+		return criteria.Limit <= 0 || len(matches) < criteria.Limit
+	}
+
+	var err error
+	if filter := criteria.Filter(); filter != nil {
+		err = db.SearchFuncFilterContext(ctx, criteria.Hash, int(criteria.Distance), filter, fn)
+	} else {
+		err = db.SearchFuncContext(ctx, criteria.Hash, int(criteria.Distance), fn)
+	}
+	return matches, err
 }
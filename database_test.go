@@ -2,9 +2,11 @@ package disgo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"image/png"
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -15,7 +17,24 @@ type testIndex struct {
 }
 
 func (ti *testIndex) Insert(PHash) error                 { return ti.err }
+func (ti *testIndex) Remove(PHash) error                 { return ti.err }
 func (ti *testIndex) Search(PHash, int) ([]PHash, error) { return ti.matches, ti.err }
+func (ti *testIndex) SearchContext(context.Context, PHash, int) ([]PHash, error) {
+	return ti.matches, ti.err
+}
+
+func (ti *testIndex) SearchFunc(hash PHash, distance int, fn func(Match) bool) error {
+	return ti.SearchFuncContext(context.Background(), hash, distance, fn)
+}
+
+func (ti *testIndex) SearchFuncContext(ctx context.Context, hash PHash, distance int, fn func(Match) bool) error {
+	for _, match := range ti.matches {
+		if !fn(Match{Hash: match, Distance: hash.Distance(match), Count: 1}) {
+			break
+		}
+	}
+	return ti.err
+}
 
 func newTestIndex() *testIndex {
 	return &testIndex{}
@@ -41,6 +60,26 @@ func TestDBAdd(t *testing.T) {
 	}
 }
 
+func TestDBAddHashes(t *testing.T) {
+	hashes := []PHash{0x42, 0x01, 0x37}
+	for _, index := range []Index{NewRadixIndex(), NewLinearIndex()} {
+		db := NewDB(index)
+		if err := db.AddHashes(hashes); err != nil {
+			t.Fatalf("Expected nil got %v", err)
+		}
+
+		for _, hash := range hashes {
+			if matches, _ := db.SearchByHash(hash, 0); len(matches) != 1 {
+				t.Errorf("%T expected %v to be added got %v", index, hash, matches)
+			}
+		}
+	}
+
+	if err := NewDB(NewCompactRadixIndex()).AddHashes(hashes); err != ErrReadOnly {
+		t.Errorf("Expected %v got %v", ErrReadOnly, err)
+	}
+}
+
 func TestDBAddFile(t *testing.T) {
 	tests := []struct {
 		expectedErr error
@@ -126,24 +165,278 @@ func TestDBSearchByFile(t *testing.T) {
 	}
 }
 
-/*
-func BenchmarkLinearIndexAdd10(b *testing.B)    { benchmarkAdd(b, NewLinearIndex(), 10) }
-func BenchmarkLinearIndexAdd100(b *testing.B)   { benchmarkAdd(b, NewLinearIndex(), 100) }
-func BenchmarkLinearIndexAdd1000(b *testing.B)  { benchmarkAdd(b, NewLinearIndex(), 1000) }
-func BenchmarkLinearIndexAdd10000(b *testing.B) { benchmarkAdd(b, NewLinearIndex(), 10000) }
+func TestDBSearchByCriteria(t *testing.T) {
+	db := New()
+	for i := 0; i < 10; i++ {
+		db.AddHash(PHash(i))
+	}
+
+	tests := []struct {
+		options  SearchOptions
+		expected []Match
+	}{
+		{SearchOptions{}, []Match{{0, 0, 1, nil}, {1, 1, 1, nil}, {2, 1, 1, nil}, {3, 2, 1, nil}, {4, 1, 1, nil}, {5, 2, 1, nil}, {6, 2, 1, nil}, {7, 3, 1, nil}, {8, 1, 1, nil}, {9, 2, 1, nil}}},
+		{SearchOptions{Limit: 2}, []Match{{0, 0, 1, nil}, {1, 1, 1, nil}}},
+		{SearchOptions{Offset: 3, Limit: 2}, []Match{{3, 2, 1, nil}, {4, 1, 1, nil}}},
+		{SearchOptions{Offset: 9, Limit: 2}, []Match{{9, 2, 1, nil}}},
+		{SearchOptions{Offset: 10}, nil},
+	}
+
+	for i, test := range tests {
+		matches, err := db.SearchByCriteria(context.Background(), SearchCriteria{Hash: 0, Distance: 64, SearchOptions: test.options})
+		if err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+		}
+
+		if !reflect.DeepEqual(test.expected, matches) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, matches)
+		}
+	}
+
+	visited := 0
+	db.SearchFunc(0, 64, func(Match) bool {
+		visited++
+		return visited < 3
+	})
+
+	if visited != 3 {
+		t.Errorf("Expected search to stop after 3 matches got %d", visited)
+	}
+}
+
+func TestDBContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	db := New()
+	db.AddHash(0x00)
+
+	img := image.NewAlpha(image.Rect(0, 0, 1, 1))
+	buf := bytes.NewBuffer([]byte{})
+	png.Encode(buf, img)
+
+	if _, err := db.AddFileContext(ctx, bytes.NewReader(buf.Bytes())); err != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, err)
+	}
+
+	if _, err := db.SearchByFileContext(ctx, bytes.NewReader(buf.Bytes()), 0); err != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, err)
+	}
+
+	if _, err := db.SearchByHashContext(ctx, 0x00, 64); err != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, err)
+	}
+
+	if err := db.ScanContext(ctx, "."); err != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, err)
+	}
+}
+
+func TestDBSaveLoad(t *testing.T) {
+	db := New()
+	db.AddHash(0x01)
+	db.addRecord(ImageInfo{Hash: 0x42, Location: "a.png", Size: 37, Checksum: "abcd"})
+
+	buf := bytes.NewBuffer(nil)
+	if err := db.Save(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	loaded := New()
+	if err := loaded.Load(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if !reflect.DeepEqual(testRecords(db), testRecords(loaded)) {
+		t.Errorf("Expected %v got %v", testRecords(db), testRecords(loaded))
+	}
+
+	for _, hash := range []PHash{0x01, 0x42} {
+		if matches, _ := loaded.SearchByHash(hash, 0); len(matches) != 1 {
+			t.Errorf("Expected %v to be loaded got %v", hash, matches)
+		}
+	}
+
+	// databases saved without records only contain the index
+	legacy, _ := db.index.(*RadixIndex).MarshalBinary()
+	loaded = New()
+	if err := loaded.Load(bytes.NewReader(legacy)); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if matches, _ := loaded.SearchByHash(0x42, 0); len(matches) != 1 {
+		t.Errorf("Expected legacy index to be loaded got %v", matches)
+	}
+
+	// bare indexes are validated rather than trusted
+	tests := [][]byte{
+		dbMagic,
+		{0x00, 200, 0, 0, 0, 0, 0, 0, 0, 0},
+		append(legacy, 0x00),
+		legacy[:len(legacy)-1],
+	}
+
+	for i, test := range tests {
+		loaded = New()
+		if err := loaded.Load(bytes.NewReader(test)); err != ErrCorrupt {
+			t.Errorf("tests[%d] expected %v got %v", i, ErrCorrupt, err)
+		}
+
+		if matches, err := loaded.SearchByHash(0, 64); err != nil || len(matches) != 0 {
+			t.Errorf("tests[%d] expected an empty index got %v (%v)", i, matches, err)
+		}
+	}
+}
+
+func TestDBSavePersistent(t *testing.T) {
+	store := persistentStore{NewMemoryStore()}
+	db, _ := NewDBWithStore(NewRadixIndex(), store)
+	db.addRecord(ImageInfo{Hash: 0x42, Location: "a.png"})
+	db.AddHash(0x42)
+	db.AddHash(0x01)
+
+	buf, err := db.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if bytes.Contains(buf, []byte("a.png")) {
+		t.Errorf("Expected the records to be left out of the snapshot")
+	}
+
+	// the store changes after the snapshot, and loading leaves it alone
+	db.addRecord(ImageInfo{Hash: 0x43, Location: "b.png"})
+	db.RemovePath("a.png")
+	if err := db.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if _, err := db.Record("b.png"); err != nil {
+		t.Errorf("Expected b.png to be kept got %v", err)
+	}
+
+	expected := []Match{{0x01, 0, 1, nil}, {0x42, 0, 1, nil}, {0x43, 0, 1, []uint64{2}}}
+	if matches := testWalk(db); !reflect.DeepEqual(expected, matches) {
+		t.Errorf("Expected %v got %v", expected, matches)
+	}
+
+	// a database with a store of its own keeps the hashes without records
+	loaded := New()
+	if err := loaded.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	expected = []Match{{0x01, 0, 1, nil}, {0x42, 0, 2, nil}}
+	if matches := testWalk(loaded); !reflect.DeepEqual(expected, matches) {
+		t.Errorf("Expected %v got %v", expected, matches)
+	}
+
+	// snapshots with records don't replace the records of a persistent store
+	memory := New()
+	memory.addRecord(ImageInfo{Hash: 0x05, Location: "c.png"})
+	memory.AddHash(0x06)
+	buf, _ = memory.MarshalBinary()
+	if err := db.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	expected = []Match{{0x06, 0, 1, nil}, {0x43, 0, 1, []uint64{2}}}
+	if matches := testWalk(db); !reflect.DeepEqual(expected, matches) {
+		t.Errorf("Expected %v got %v", expected, matches)
+	}
+}
+
+// benchmarkHashes generates clusters of 16 similar hashes so that searches
+// find several matches
+func benchmarkHashes(n int) []PHash {
+	rng := rand.New(rand.NewSource(int64(n)))
+	hashes := make([]PHash, n)
+	var base PHash
+	for i := range hashes {
+		if i%16 == 0 {
+			base = PHash(rng.Uint64())
+		}
+		hashes[i] = base ^ 1<<uint(rng.Intn(64)) ^ 1<<uint(rng.Intn(64))
+	}
+	return hashes
+}
+
+func benchmarkAdd(b *testing.B, newIndex func() Index, n int) {
+	hashes := benchmarkHashes(n)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		index := newIndex()
+		for _, hash := range hashes {
+			index.Insert(hash)
+		}
+	}
+}
+
+func benchmarkSearch(b *testing.B, index Index, n int) {
+	hashes := benchmarkHashes(n)
+	for _, hash := range hashes {
+		index.Insert(hash)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Search(hashes[i%n], 10)
+	}
+}
+
+func benchmarkAppendSearch(b *testing.B, n int) {
+	index := NewRadixIndex()
+	hashes := benchmarkHashes(n)
+	for _, hash := range hashes {
+		index.Insert(hash)
+	}
+
+	buf := make([]PHash, 0, n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = index.AppendSearch(buf[:0], hashes[i%n], 10)
+	}
+}
+
+func benchmarkBuild(b *testing.B, n int) {
+	hashes := benchmarkHashes(n)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		BuildRadixIndex(hashes)
+	}
+}
+
+func newLinearIndex() Index { return NewLinearIndex() }
+func newRadixIndex() Index  { return NewRadixIndex() }
+
+func BenchmarkLinearIndexAdd10(b *testing.B)    { benchmarkAdd(b, newLinearIndex, 10) }
+func BenchmarkLinearIndexAdd100(b *testing.B)   { benchmarkAdd(b, newLinearIndex, 100) }
+func BenchmarkLinearIndexAdd1000(b *testing.B)  { benchmarkAdd(b, newLinearIndex, 1000) }
+func BenchmarkLinearIndexAdd10000(b *testing.B) { benchmarkAdd(b, newLinearIndex, 10000) }
 
 func BenchmarkLinearIndexSearch10(b *testing.B)    { benchmarkSearch(b, NewLinearIndex(), 10) }
 func BenchmarkLinearIndexSearch100(b *testing.B)   { benchmarkSearch(b, NewLinearIndex(), 100) }
 func BenchmarkLinearIndexSearch1000(b *testing.B)  { benchmarkSearch(b, NewLinearIndex(), 1000) }
 func BenchmarkLinearIndexSearch10000(b *testing.B) { benchmarkSearch(b, NewLinearIndex(), 10000) }
 
-func BenchmarkRadixIndexAdd10(b *testing.B)    { benchmarkAdd(b, NewRadixIndex(), 10) }
-func BenchmarkRadixIndexAdd100(b *testing.B)   { benchmarkAdd(b, NewRadixIndex(), 100) }
-func BenchmarkRadixIndexAdd1000(b *testing.B)  { benchmarkAdd(b, NewRadixIndex(), 1000) }
-func BenchmarkRadixIndexAdd10000(b *testing.B) { benchmarkAdd(b, NewRadixIndex(), 10000) }
+func BenchmarkRadixIndexAdd10(b *testing.B)    { benchmarkAdd(b, newRadixIndex, 10) }
+func BenchmarkRadixIndexAdd100(b *testing.B)   { benchmarkAdd(b, newRadixIndex, 100) }
+func BenchmarkRadixIndexAdd1000(b *testing.B)  { benchmarkAdd(b, newRadixIndex, 1000) }
+func BenchmarkRadixIndexAdd10000(b *testing.B) { benchmarkAdd(b, newRadixIndex, 10000) }
+
+func BenchmarkBuildRadixIndex10(b *testing.B)    { benchmarkBuild(b, 10) }
+func BenchmarkBuildRadixIndex100(b *testing.B)   { benchmarkBuild(b, 100) }
+func BenchmarkBuildRadixIndex1000(b *testing.B)  { benchmarkBuild(b, 1000) }
+func BenchmarkBuildRadixIndex10000(b *testing.B) { benchmarkBuild(b, 10000) }
 
 func BenchmarkRadixIndexSearch10(b *testing.B)    { benchmarkSearch(b, NewRadixIndex(), 10) }
 func BenchmarkRadixIndexSearch100(b *testing.B)   { benchmarkSearch(b, NewRadixIndex(), 100) }
 func BenchmarkRadixIndexSearch1000(b *testing.B)  { benchmarkSearch(b, NewRadixIndex(), 1000) }
 func BenchmarkRadixIndexSearch10000(b *testing.B) { benchmarkSearch(b, NewRadixIndex(), 10000) }
-*/
+
+func BenchmarkRadixIndexAppendSearch10(b *testing.B)    { benchmarkAppendSearch(b, 10) }
+func BenchmarkRadixIndexAppendSearch100(b *testing.B)   { benchmarkAppendSearch(b, 100) }
+func BenchmarkRadixIndexAppendSearch1000(b *testing.B)  { benchmarkAppendSearch(b, 1000) }
+func BenchmarkRadixIndexAppendSearch10000(b *testing.B) { benchmarkAppendSearch(b, 10000) }
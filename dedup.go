@@ -0,0 +1,393 @@
+package disgo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrNoQuarantine  = errors.New("Quarantine directory is required")
+	ErrNoBackup      = errors.New("No backup of the original file was kept")
+	ErrNotReviewed   = errors.New("Dedup plan has not been reviewed")
+	ErrChanged       = errors.New("File has changed since the dedup plan was made")
+	ErrUnknownAction = errors.New("Unknown dedup action")
+)
+
+// Action is what Dedup does with the duplicates that are not kept
+type Action string
+
+const (
+	// ActionHardlink replaces duplicates with a hard link to the kept image
+	ActionHardlink Action = "hardlink"
+
+	// ActionSymlink replaces duplicates with a symbolic link to the kept image
+	ActionSymlink Action = "symlink"
+
+	// ActionQuarantine moves duplicates into the quarantine directory
+	ActionQuarantine Action = "quarantine"
+
+	// ActionDelete deletes duplicates
+	ActionDelete Action = "delete"
+)
+
+// KeepPolicy compares two images from a duplicate group.  It returns a
+// negative number if a should be kept in preference to b, a positive number
+// if b should be kept and zero if the policy has no preference
+type KeepPolicy func(a, b ImageInfo) int
+
+// KeepLargestResolution prefers the image with the most pixels
+func KeepLargestResolution(a, b ImageInfo) int {
+	return b.Width*b.Height - a.Width*a.Height
+}
+
+// KeepLargestFile prefers the biggest file
+func KeepLargestFile(a, b ImageInfo) int {
+	switch {
+	case a.Size > b.Size:
+		return -1
+	case a.Size < b.Size:
+		return 1
+	}
+	return 0
+}
+
+// KeepOldest prefers the file with the oldest modification time
+func KeepOldest(a, b ImageInfo) int {
+	switch {
+	case a.ModTime.Before(b.ModTime):
+		return -1
+	case b.ModTime.Before(a.ModTime):
+		return 1
+	}
+	return 0
+}
+
+// KeepPrefix prefers images whose location starts with prefix
+func KeepPrefix(prefix string) KeepPolicy {
+	return func(a, b ImageInfo) int {
+		aMatch := strings.HasPrefix(a.Location, prefix)
+		bMatch := strings.HasPrefix(b.Location, prefix)
+		switch {
+		case aMatch && !bMatch:
+			return -1
+		case bMatch && !aMatch:
+			return 1
+		}
+		return 0
+	}
+}
+
+// DedupStep is a single duplicate that will be acted on
+type DedupStep struct {
+	Keep      ImageInfo `json:"keep"`
+	Duplicate ImageInfo `json:"duplicate"`
+	Distance  int       `json:"distance"`
+}
+
+// DedupPlan describes what Dedup will do.  Plans are created by PlanDedup
+// and must be reviewed before they are executed
+type DedupPlan struct {
+	Action Action      `json:"action"`
+	Steps  []DedupStep `json:"steps"`
+
+	// Reviewed acknowledges the plan.  It is set by WriteReport, or can be
+	// set directly for a plan that was reviewed some other way, such as by
+	// reading its JSON.  Dedup refuses plans that haven't been reviewed
+	Reviewed bool `json:"reviewed,omitempty"`
+
+	// Quarantine is the directory duplicates are moved to.  It is required
+	// for ActionQuarantine.  For the other actions the original files are
+	// moved there, when it is set, so that Dedup can be undone
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// PlanDedup chooses one image to keep from each group and plans action for
+// the rest.  The policies are applied in order until one of them has a
+// preference; any remaining ties keep the first location in sort order.
+// Images without a location are ignored, and an image that is kept in one
+// group is never acted on in another
+func PlanDedup(groups []DuplicateGroup, action Action, policies ...KeepPolicy) *DedupPlan {
+	prefer := func(a, b ImageInfo) bool {
+		for _, policy := range policies {
+			if cmp := policy(a, b); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return a.Location < b.Location
+	}
+
+	plan := &DedupPlan{Action: action}
+	keepers := make(map[string]bool)
+	var candidates []DedupStep
+	for _, group := range groups {
+		var images []ImageInfo
+		for _, info := range group.Images {
+			if info.Location != "" {
+				images = append(images, info)
+			}
+		}
+
+		if len(images) < 2 {
+			continue
+		}
+
+		sort.Slice(images, func(i, j int) bool { return prefer(images[i], images[j]) })
+		keepers[images[0].Location] = true
+		for _, duplicate := range images[1:] {
+			candidates = append(candidates, DedupStep{
+				Keep:      images[0],
+				Duplicate: duplicate,
+				Distance:  images[0].Hash.Distance(duplicate.Hash),
+			})
+		}
+	}
+
+	planned := make(map[string]bool)
+	for _, step := range candidates {
+		if keepers[step.Duplicate.Location] || planned[step.Duplicate.Location] {
+			continue
+		}
+		planned[step.Duplicate.Location] = true
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan
+}
+
+// WriteReport writes a human readable description of the plan to writer
+// without touching any files, and marks the plan as Reviewed
+func (plan *DedupPlan) WriteReport(writer io.Writer) error {
+	for _, step := range plan.Steps {
+		_, err := fmt.Fprintf(writer, "%-10s %s (distance %d from %s)\n", plan.Action, step.Duplicate.Location, step.Distance, step.Keep.Location)
+		if err != nil {
+			return err
+		}
+	}
+	plan.Reviewed = true
+	return nil
+}
+
+// verifyFile returns ErrChanged unless the file at info.Location still has
+// the size, modification time and checksum recorded in info
+func verifyFile(info ImageInfo) error {
+	file, err := os.Open(info.Location)
+	if os.IsNotExist(err) {
+		return ErrChanged
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() != info.Size || !stat.ModTime().Equal(info.ModTime) {
+		return ErrChanged
+	}
+
+	if info.Checksum != "" {
+		sum, err := checksum(file)
+		if err != nil {
+			return err
+		} else if sum != info.Checksum {
+			return ErrChanged
+		}
+	}
+	return nil
+}
+
+// JournalEntry records a single completed Dedup step so that it can be
+// reversed by UndoDedup
+type JournalEntry struct {
+	Action   Action `json:"action"`
+	Location string `json:"location"`
+	Keep     string `json:"keep"`
+	Backup   string `json:"backup,omitempty"`
+}
+
+// moveFile renames from to to, falling back to copying the file when the
+// two are on different file systems
+func moveFile(from, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err == nil {
+		err = os.Rename(from, to)
+	}
+
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	reader, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.Create(to)
+	if err == nil {
+		_, err = io.Copy(writer, reader)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err == nil {
+		err = os.Remove(from)
+	}
+	return err
+}
+
+// replace atomically replaces location with the link created by link
+func replace(location string, link func(string) error) error {
+	tmp := location + ".disgo"
+	err := link(tmp)
+	if err == nil {
+		err = os.Rename(tmp, location)
+	}
+	return err
+}
+
+// Dedup carries out plan, which must have been reviewed, writing a
+// JournalEntry (as a line of JSON) to journal as each step completes.  The
+// records in the database are updated to match.  Before each step the
+// duplicate and the kept image are checked against the plan; steps whose
+// files have changed are skipped, and Dedup carries on and returns
+// ErrChanged.  Plans whose action isn't one of the Action constants are
+// rejected with ErrUnknownAction before anything is touched.  Only plans
+// with a quarantine directory can be completely undone
+func (db *DB) Dedup(plan *DedupPlan, journal io.Writer) error {
+	switch plan.Action {
+	case ActionHardlink, ActionSymlink, ActionQuarantine, ActionDelete:
+	default:
+		return ErrUnknownAction
+	}
+
+	if plan.Action == ActionQuarantine && plan.Quarantine == "" {
+		return ErrNoQuarantine
+	} else if !plan.Reviewed {
+		return ErrNotReviewed
+	}
+
+	var result error
+	encoder := json.NewEncoder(journal)
+	for _, step := range plan.Steps {
+		entry := JournalEntry{
+			Action:   plan.Action,
+			Location: step.Duplicate.Location,
+			Keep:     step.Keep.Location,
+		}
+
+		err := verifyFile(step.Keep)
+		if err == nil {
+			err = verifyFile(step.Duplicate)
+		}
+
+		if err == ErrChanged {
+			result = ErrChanged
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if plan.Quarantine != "" {
+			var abs string
+			abs, err = filepath.Abs(entry.Location)
+			if err == nil {
+				entry.Backup = filepath.Join(plan.Quarantine, abs)
+				err = moveFile(entry.Location, entry.Backup)
+			}
+		} else if plan.Action == ActionDelete {
+			err = os.Remove(entry.Location)
+		}
+
+		if err == nil {
+			switch plan.Action {
+			case ActionHardlink:
+				err = replace(entry.Location, func(tmp string) error { return os.Link(entry.Keep, tmp) })
+			case ActionSymlink:
+				var target string
+				target, err = filepath.Abs(entry.Keep)
+				if err == nil {
+					err = replace(entry.Location, func(tmp string) error { return os.Symlink(target, tmp) })
+				}
+			}
+		}
+
+		if err == nil {
+			err = encoder.Encode(entry)
+		}
+
+		if err == nil {
+			if plan.Action == ActionHardlink || plan.Action == ActionSymlink {
+				info := step.Keep
+				info.Location = entry.Location
+				info.ID = 0
+				_, err = db.putRecord(info)
+			} else if err = db.RemovePath(entry.Location); err == ErrNotFound {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return result
+}
+
+// UndoDedup reverses the steps recorded in journal, most recent first, and
+// adds the restored files back to the database.  Steps without a backup
+// can't be undone; UndoDedup continues past them and returns ErrNoBackup
+func (db *DB) UndoDedup(journal io.Reader) error {
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var result error
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Backup == "" {
+			result = ErrNoBackup
+			continue
+		}
+
+		var err error
+		if entry.Action == ActionHardlink || entry.Action == ActionSymlink {
+			err = os.Remove(entry.Location)
+		}
+
+		if err == nil {
+			err = moveFile(entry.Backup, entry.Location)
+		}
+
+		if err == nil {
+			_, err = db.AddPath(entry.Location)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return result
+}
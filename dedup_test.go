@@ -0,0 +1,177 @@
+package disgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanDedup(t *testing.T) {
+	now := time.Now()
+	a := ImageInfo{Hash: 0x00, Location: "/a/1.png", Size: 10, Width: 20, Height: 20, ModTime: now}
+	b := ImageInfo{Hash: 0x01, Location: "/b/2.png", Size: 20, Width: 10, Height: 10, ModTime: now.Add(-time.Hour)}
+	c := ImageInfo{Hash: 0x03, Location: "/b/3.png", Size: 20, Width: 10, Height: 10, ModTime: now}
+	groups := []DuplicateGroup{{Images: []ImageInfo{a, b, c, {Hash: 0x03}}}}
+
+	tests := []struct {
+		policies []KeepPolicy
+		keep     string
+		removed  []string
+	}{
+		{nil, "/a/1.png", []string{"/b/2.png", "/b/3.png"}},
+		{[]KeepPolicy{KeepLargestFile}, "/b/2.png", []string{"/b/3.png", "/a/1.png"}},
+		{[]KeepPolicy{KeepLargestFile, KeepOldest}, "/b/2.png", []string{"/b/3.png", "/a/1.png"}},
+		{[]KeepPolicy{KeepLargestResolution}, "/a/1.png", []string{"/b/2.png", "/b/3.png"}},
+		{[]KeepPolicy{KeepPrefix("/b/"), KeepOldest}, "/b/2.png", []string{"/b/3.png", "/a/1.png"}},
+		{[]KeepPolicy{KeepPrefix("/b/3")}, "/b/3.png", []string{"/a/1.png", "/b/2.png"}},
+	}
+
+	for i, test := range tests {
+		plan := PlanDedup(groups, ActionDelete, test.policies...)
+		var removed []string
+		for _, step := range plan.Steps {
+			if step.Keep.Location != test.keep {
+				t.Errorf("tests[%d] expected to keep %s got %s", i, test.keep, step.Keep.Location)
+			}
+			removed = append(removed, step.Duplicate.Location)
+		}
+
+		if !reflect.DeepEqual(test.removed, removed) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.removed, removed)
+		}
+	}
+
+	// images kept in one group are never removed by another
+	plan := PlanDedup([]DuplicateGroup{{Images: []ImageInfo{a, b}}, {Images: []ImageInfo{b, c}}}, ActionDelete)
+	if len(plan.Steps) != 1 || plan.Steps[0].Duplicate.Location != "/b/3.png" {
+		t.Errorf("Expected only /b/3.png to be removed got %v", plan.Steps)
+	}
+}
+
+func setupDedup(t *testing.T) (string, *DB, *DedupPlan) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	writeTestImage(t, filepath.Join(dir, "keep.png"), 0x81)
+	writeTestImage(t, filepath.Join(dir, "copy.png"), 0x81)
+
+	db := New()
+	db.Scan(dir)
+	groups, _ := db.FindDuplicates(0, GroupComponents)
+	plan := PlanDedup(groups, ActionQuarantine, KeepPrefix(filepath.Join(dir, "keep")))
+	plan.Quarantine = filepath.Join(dir, "quarantine")
+	return dir, db, plan
+}
+
+func TestDedupQuarantine(t *testing.T) {
+	dir, db, plan := setupDedup(t)
+	defer os.RemoveAll(dir)
+
+	if err := db.Dedup(plan, ioutil.Discard); err != ErrNotReviewed {
+		t.Errorf("Expected %v got %v", ErrNotReviewed, err)
+	}
+
+	report := bytes.NewBuffer(nil)
+	plan.WriteReport(report)
+	if !bytes.Contains(report.Bytes(), []byte("copy.png")) {
+		t.Errorf("Expected report to mention copy.png got %q", report.String())
+	}
+
+	copyPath := filepath.Join(dir, "copy.png")
+	journal := bytes.NewBuffer(nil)
+	if err := db.Dedup(plan, journal); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if _, err := os.Stat(copyPath); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be moved got %v", copyPath, err)
+	}
+
+	if _, err := db.Record(copyPath); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	if err := db.UndoDedup(journal); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if _, err := db.Record(copyPath); err != nil {
+		t.Errorf("Expected %s to be restored got %v", copyPath, err)
+	}
+
+	plan.Quarantine = ""
+	if err := db.Dedup(plan, journal); err != ErrNoQuarantine {
+		t.Errorf("Expected %v got %v", ErrNoQuarantine, err)
+	}
+
+	// a mistyped action must not drop the records of files left in place
+	plan.Action = "quarantined"
+	if err := db.Dedup(plan, journal); err != ErrUnknownAction {
+		t.Errorf("Expected %v got %v", ErrUnknownAction, err)
+	}
+
+	if _, err := db.Record(copyPath); err != nil {
+		t.Errorf("Expected %s to be kept got %v", copyPath, err)
+	}
+}
+
+func TestDedupHardlink(t *testing.T) {
+	dir, db, plan := setupDedup(t)
+	defer os.RemoveAll(dir)
+
+	plan.Action = ActionHardlink
+	plan.Reviewed = true
+	journal := bytes.NewBuffer(nil)
+	if err := db.Dedup(plan, journal); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	keep, _ := os.Stat(filepath.Join(dir, "keep.png"))
+	copy, _ := os.Stat(filepath.Join(dir, "copy.png"))
+	if !os.SameFile(keep, copy) {
+		t.Errorf("Expected copy.png to be linked to keep.png")
+	}
+
+	if err := db.UndoDedup(bytes.NewReader(journal.Bytes())); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	copy, _ = os.Stat(filepath.Join(dir, "copy.png"))
+	if os.SameFile(keep, copy) {
+		t.Errorf("Expected copy.png to be restored")
+	}
+
+	plan.Quarantine = ""
+	plan.Action = ActionDelete
+	journal.Reset()
+	db.Dedup(plan, journal)
+	if err := db.UndoDedup(journal); err != ErrNoBackup {
+		t.Errorf("Expected %v got %v", ErrNoBackup, err)
+	}
+}
+
+func TestDedupChanged(t *testing.T) {
+	dir, db, plan := setupDedup(t)
+	defer os.RemoveAll(dir)
+	plan.WriteReport(ioutil.Discard)
+
+	// the duplicate is rewritten after the plan was made
+	copyPath := filepath.Join(dir, "copy.png")
+	writeTestImage(t, copyPath, 0x18)
+	os.Chtimes(copyPath, time.Now(), time.Now().Add(time.Hour))
+
+	journal := bytes.NewBuffer(nil)
+	if err := db.Dedup(plan, journal); err != ErrChanged {
+		t.Errorf("Expected %v got %v", ErrChanged, err)
+	}
+
+	if _, err := os.Stat(copyPath); err != nil {
+		t.Errorf("Expected %s to be left alone got %v", copyPath, err)
+	}
+
+	if journal.Len() != 0 {
+		t.Errorf("Expected an empty journal got %q", journal.String())
+	}
+}
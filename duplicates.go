@@ -0,0 +1,285 @@
+package disgo
+
+import (
+	"slices"
+	"sort"
+)
+
+// Pair is two hashes that are within some distance of each other
+type Pair struct {
+	Hash1    PHash `json:"hash1"`
+	Hash2    PHash `json:"hash2"`
+	Distance int   `json:"distance"`
+}
+
+// PairIndex is implemented by indexes that can find every pair of hashes
+// within a given distance of each other without searching for each hash
+// individually
+type PairIndex interface {
+	Pairs(int) ([]Pair, error)
+}
+
+// Grouping determines how FindDuplicates divides near-identical images
+// into groups
+type Grouping int
+
+const (
+	// GroupComponents puts images in the same group if they are connected
+	// by any chain of matches, so two images in a group may be further apart
+	// than the search distance
+	GroupComponents Grouping = iota
+
+	// GroupCliques reports every maximal group of images that are all
+	// within the search distance of each other.  An image may belong to
+	// more than one group
+	GroupCliques
+)
+
+// DuplicateGroup is a set of near-identical images.  Pairs holds the
+// distance between every two distinct hashes in the group that are within
+// the search distance; images that share a hash are exact duplicates
+type DuplicateGroup struct {
+	Images []ImageInfo `json:"images"`
+	Pairs  []Pair      `json:"pairs"`
+}
+
+// FindDuplicates finds all groups of images whose hashes are within
+// maxDistance of each other.  Hashes that were added without a record
+// appear as images with only the Hash set
+func (db *DB) FindDuplicates(maxDistance int, grouping Grouping) ([]DuplicateGroup, error) {
+	return db.FindDuplicatesFilter(maxDistance, grouping, nil)
+}
+
+// FindDuplicatesFilter is like FindDuplicates, but only groups the images
+// selected by filter.  Hashes that were added without a record are never
+// selected.  FilterInformative keeps blank and solid color images, which
+// would otherwise form large false groups, out of the results (see
+// LowInformationGroup)
+func (db *DB) FindDuplicatesFilter(maxDistance int, grouping Grouping, filter Filter) ([]DuplicateGroup, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	finder, ok := db.index.(PairIndex)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	pairs, err := finder.Pairs(maxDistance)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make(map[PHash][]ImageInfo)
+	err = db.records.Walk(func(info ImageInfo) error {
+		if filter == nil || filter(info) {
+			images[info.Hash] = append(images[info.Hash], info)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if filter != nil {
+		selected := pairs[:0:0]
+		for _, pair := range pairs {
+			if images[pair.Hash1] != nil && images[pair.Hash2] != nil {
+				selected = append(selected, pair)
+			}
+		}
+		pairs = selected
+	}
+
+	neighbors := make(map[PHash]map[PHash]bool)
+	for _, pair := range pairs {
+		for _, hash := range []PHash{pair.Hash1, pair.Hash2} {
+			if neighbors[hash] == nil {
+				neighbors[hash] = make(map[PHash]bool)
+			}
+		}
+		neighbors[pair.Hash1][pair.Hash2] = true
+		neighbors[pair.Hash2][pair.Hash1] = true
+	}
+
+	// exact duplicates form a group even without any neighbors
+	for hash, infos := range images {
+		if len(infos) > 1 && neighbors[hash] == nil {
+			neighbors[hash] = make(map[PHash]bool)
+		}
+	}
+
+	var hashGroups [][]PHash
+	for _, component := range components(neighbors) {
+		if grouping == GroupCliques {
+			hashGroups = append(hashGroups, cliques(component, neighbors)...)
+		} else {
+			hashGroups = append(hashGroups, component)
+		}
+	}
+
+	// groupsOf maps each hash to the groups it is in.  Components don't
+	// overlap, but a hash can be in several cliques
+	var groups []DuplicateGroup
+	var members []map[PHash]bool
+	groupsOf := make(map[PHash][]int)
+	for _, hashes := range hashGroups {
+		group := DuplicateGroup{}
+		for _, hash := range hashes {
+			if infos, found := images[hash]; found {
+				group.Images = append(group.Images, infos...)
+			} else {
+				group.Images = append(group.Images, ImageInfo{Hash: hash})
+			}
+		}
+
+		if len(group.Images) < 2 {
+			continue
+		}
+
+		set := make(map[PHash]bool, len(hashes))
+		for _, hash := range hashes {
+			set[hash] = true
+			groupsOf[hash] = append(groupsOf[hash], len(groups))
+		}
+
+		sortImages(group.Images)
+		groups = append(groups, group)
+		members = append(members, set)
+	}
+
+	for _, pair := range pairs {
+		for _, i := range groupsOf[pair.Hash1] {
+			if members[i][pair.Hash2] {
+				groups[i].Pairs = append(groups[i].Pairs, pair)
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// LowInformationGroup returns every image flagged as LowInformation as a
+// single group, since their hashes say little about whether they are
+// duplicates of each other
+func (db *DB) LowInformationGroup() (DuplicateGroup, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var group DuplicateGroup
+	err := db.records.Walk(func(info ImageInfo) error {
+		if info.LowInformation {
+			group.Images = append(group.Images, info)
+		}
+		return nil
+	})
+
+	sortImages(group.Images)
+	return group, err
+}
+
+// sortImages sorts images by hash, then location
+func sortImages(images []ImageInfo) {
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Hash == images[j].Hash {
+			return images[i].Location < images[j].Location
+		}
+		return images[i].Hash < images[j].Hash
+	})
+}
+
+// sortHashes sorts hashes in ascending order
+func sortHashes(hashes []PHash) {
+	slices.Sort(hashes)
+}
+
+// components finds the connected components of the graph
+func components(neighbors map[PHash]map[PHash]bool) [][]PHash {
+	var hashes []PHash
+	for hash := range neighbors {
+		hashes = append(hashes, hash)
+	}
+	sortHashes(hashes)
+
+	var components [][]PHash
+	visited := make(map[PHash]bool)
+	for _, hash := range hashes {
+		if visited[hash] {
+			continue
+		}
+
+		visited[hash] = true
+		component := []PHash{hash}
+		for i := 0; i < len(component); i++ {
+			for neighbor := range neighbors[component[i]] {
+				if !visited[neighbor] {
+					visited[neighbor] = true
+					component = append(component, neighbor)
+				}
+			}
+		}
+		sortHashes(component)
+		components = append(components, component)
+	}
+	return components
+}
+
+// cliques finds the maximal cliques within a connected component using the
+// Bron-Kerbosch algorithm with pivoting
+func cliques(component []PHash, neighbors map[PHash]map[PHash]bool) [][]PHash {
+	var cliques [][]PHash
+	intersect := func(set []PHash, hash PHash) (result []PHash) {
+		for _, member := range set {
+			if neighbors[hash][member] {
+				result = append(result, member)
+			}
+		}
+		return result
+	}
+
+	var expand func(clique, candidates, excluded []PHash)
+	expand = func(clique, candidates, excluded []PHash) {
+		if len(candidates) == 0 && len(excluded) == 0 {
+			clique = append([]PHash(nil), clique...)
+			sortHashes(clique)
+			cliques = append(cliques, clique)
+			return
+		}
+
+		var pivot PHash
+		degree := -1
+		for _, set := range [][]PHash{candidates, excluded} {
+			for _, hash := range set {
+				if len(neighbors[hash]) > degree {
+					pivot, degree = hash, len(neighbors[hash])
+				}
+			}
+		}
+
+		for _, hash := range append([]PHash(nil), candidates...) {
+			if neighbors[pivot][hash] {
+				continue
+			}
+
+			expand(append(clique, hash), intersect(candidates, hash), intersect(excluded, hash))
+			for i, candidate := range candidates {
+				if candidate == hash {
+					candidates = append(candidates[:i:i], candidates[i+1:]...)
+					break
+				}
+			}
+			excluded = append(excluded, hash)
+		}
+	}
+
+	expand(nil, component, nil)
+	sort.Slice(cliques, func(i, j int) bool {
+		for k := 0; k < len(cliques[i]) && k < len(cliques[j]); k++ {
+			if cliques[i][k] != cliques[j][k] {
+				return cliques[i][k] < cliques[j][k]
+			}
+		}
+		return len(cliques[i]) < len(cliques[j])
+	})
+	return cliques
+}
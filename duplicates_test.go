@@ -0,0 +1,93 @@
+package disgo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDBFindDuplicates(t *testing.T) {
+	records := []ImageInfo{
+		{Hash: 0x00, Location: "a.png"},
+		{Hash: 0x01, Location: "b.png"},
+		{Hash: 0x03, Location: "c.png"},
+		{Hash: 0xf0 << 56, Location: "d.png"},
+		{Hash: 0xf0 << 56, Location: "e.png"},
+		{Hash: 0x0f << 32, Location: "f.png"},
+	}
+
+	tests := []struct {
+		grouping Grouping
+		expected [][]string
+		pairs    []int
+	}{
+		{GroupComponents, [][]string{{"a.png", "b.png", "c.png", ""}, {"f.png", ""}, {"d.png", "e.png"}}, []int{3, 1, 0}},
+		{GroupCliques, [][]string{{"a.png", "b.png"}, {"b.png", "c.png"}, {"c.png", ""}, {"f.png", ""}, {"d.png", "e.png"}}, []int{1, 1, 1, 1, 0}},
+	}
+
+	for i, test := range tests {
+		db := New()
+		for _, info := range records {
+			db.addRecord(info)
+		}
+		// hashes without records show up with an empty location
+		db.AddHash(0x07)
+		db.AddHash(0x1f << 32)
+
+		groups, err := db.FindDuplicates(1, test.grouping)
+		if err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+			continue
+		}
+
+		var locations [][]string
+		var pairs []int
+		for _, group := range groups {
+			pairs = append(pairs, len(group.Pairs))
+			var names []string
+			for _, info := range group.Images {
+				names = append(names, info.Location)
+			}
+			locations = append(locations, names)
+		}
+
+		if !reflect.DeepEqual(test.expected, locations) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, locations)
+		}
+
+		if !reflect.DeepEqual(test.pairs, pairs) {
+			t.Errorf("tests[%d] expected %v pairs got %v", i, test.pairs, pairs)
+		}
+	}
+
+	if _, err := NewDB(newTestIndex()).FindDuplicates(1, GroupComponents); err != ErrNotSupported {
+		t.Errorf("Expected %v got %v", ErrNotSupported, err)
+	}
+}
+
+func TestDBFindDuplicatesFilter(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x00, Location: "blank.png", LowInformation: true})
+	db.addRecord(ImageInfo{Hash: 0x00, Location: "white.png", LowInformation: true})
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "a.png"})
+	db.addRecord(ImageInfo{Hash: 0x03, Location: "b.png"})
+	db.AddHash(0x07)
+
+	groups, err := db.FindDuplicatesFilter(1, GroupComponents, FilterInformative)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	expected := []DuplicateGroup{{
+		Images: []ImageInfo{{ID: 3, Hash: 0x01, Location: "a.png"}, {ID: 4, Hash: 0x03, Location: "b.png"}},
+		Pairs:  []Pair{{0x01, 0x03, 1}},
+	}}
+
+	if !reflect.DeepEqual(expected, groups) {
+		t.Errorf("Expected %v got %v", expected, groups)
+	}
+
+	group, err := db.LowInformationGroup()
+	if err != nil || len(group.Images) != 2 || group.Images[0].Location != "blank.png" || group.Images[1].Location != "white.png" {
+		t.Errorf("Expected the blank images got %v (%v)", group, err)
+	}
+}
@@ -0,0 +1,95 @@
+package disgo
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Walker is implemented by indexes that can visit every hash they hold
+type Walker interface {
+	// Walk calls fn for each hash in the index, with its Count (and IDs,
+	// for a PostingIndex) set, until fn returns false
+	Walk(fn func(Match) bool) error
+}
+
+// walkSearch walks index with a search that every hash is within range of
+func walkSearch(index Index, fn func(Match) bool) error {
+	return index.SearchFunc(0, 64, func(match Match) bool {
+		match.Distance = 0
+		return fn(match)
+	})
+}
+
+// Walk visits the hashes in ascending order
+func (ri *RadixIndex) Walk(fn func(Match) bool) error { return walkSearch(ri, fn) }
+
+// Walk visits the hashes in ascending order
+func (ci *CompactRadixIndex) Walk(fn func(Match) bool) error { return walkSearch(ci, fn) }
+
+// Walk visits the hashes in ascending order
+func (li *LinearIndex) Walk(fn func(Match) bool) error {
+	hashes := make([]PHash, 0, len(li.entries))
+	for hash := range li.entries {
+		hashes = append(hashes, hash)
+	}
+	sortHashes(hashes)
+
+	for _, hash := range hashes {
+		if !fn(Match{Hash: hash, Count: li.entries[hash], IDs: li.postings.ids(hash)}) {
+			break
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for each hash in the index until fn returns false.  Indexes
+// that don't implement Walker are walked with a search that matches every
+// hash.  The database is locked for reading until Walk returns, so fn must
+// not modify it
+func (db *DB) Walk(fn func(Match) bool) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.walk(fn)
+}
+
+func (db *DB) walk(fn func(Match) bool) error {
+	if walker, ok := db.index.(Walker); ok {
+		return walker.Walk(fn)
+	}
+	return walkSearch(db.index, fn)
+}
+
+// ExportEntry is a line written by Export: a hash, the number of times it
+// is in the index and the records of the images that have it.  Count is
+// larger than the number of records when the hash was also added without
+// a record (see AddHash)
+type ExportEntry struct {
+	Hash    PHash       `json:"hash"`
+	Count   int         `json:"count"`
+	Records []ImageInfo `json:"records,omitempty"`
+}
+
+// Export writes an ExportEntry for every hash in the index to writer as
+// JSON Lines, so that the database can be migrated or analysed by other
+// tools without loading it all at once.  Collections are not included;
+// export them separately
+func (db *DB) Export(writer io.Writer) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	encoder := json.NewEncoder(writer)
+	var err error
+	walkErr := db.walk(func(match Match) bool {
+		entry := ExportEntry{Hash: match.Hash, Count: match.Count}
+		entry.Records, err = db.records.Hash(match.Hash)
+		if err == nil {
+			err = encoder.Encode(entry)
+		}
+		return err == nil
+	})
+
+	if err == nil {
+		err = walkErr
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package disgo
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testWalk returns every match walked in db
+func testWalk(db *DB) []Match {
+	var matches []Match
+	db.Walk(func(match Match) bool {
+		matches = append(matches, match)
+		return true
+	})
+	return matches
+}
+
+func TestIndexWalk(t *testing.T) {
+	hashes := []PHash{0x03, 0x01, 0x01, 0xff << 56}
+	linear := NewLinearIndex()
+	for _, hash := range hashes {
+		linear.Insert(hash)
+	}
+
+	expected := []Match{{0x01, 0, 2, nil}, {0x03, 0, 1, nil}, {0xff << 56, 0, 1, nil}}
+	for i, index := range []Walker{BuildRadixIndex(hashes), BuildRadixIndex(hashes).Compact(), linear} {
+		var matches []Match
+		index.Walk(func(match Match) bool {
+			matches = append(matches, match)
+			return true
+		})
+
+		if !reflect.DeepEqual(expected, matches) {
+			t.Errorf("tests[%d] expected %v got %v", i, expected, matches)
+		}
+
+		matches = nil
+		index.Walk(func(match Match) bool {
+			matches = append(matches, match)
+			return false
+		})
+
+		if len(matches) != 1 {
+			t.Errorf("tests[%d] expected 1 match got %v", i, matches)
+		}
+	}
+}
+
+func TestDBExport(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "a.png"})
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "b.png"})
+	db.AddHash(0x01)
+	db.AddHash(0x02)
+
+	buf := bytes.NewBuffer(nil)
+	if err := db.Export(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	zero := `"mtime":"0001-01-01T00:00:00Z","checksum":"","width":0,"height":0`
+	expected := strings.Join([]string{
+		`{"hash":"0000000000000001","count":3,"records":[{"id":1,"hash":"0000000000000001","location":"a.png","size":0,` + zero + `},{"id":2,"hash":"0000000000000001","location":"b.png","size":0,` + zero + `}]}`,
+		`{"hash":"0000000000000002","count":1}`,
+		``,
+	}, "\n")
+
+	if buf.String() != expected {
+		t.Errorf("Expected %s got %s", expected, buf.String())
+	}
+
+	// indexes that can't walk themselves are walked with a search
+	index := newTestIndex()
+	index.matches = []PHash{0x05}
+	var matches []Match
+	NewDB(index).Walk(func(match Match) bool {
+		matches = append(matches, match)
+		return true
+	})
+
+	if expected := []Match{{0x05, 0, 1, nil}}; !reflect.DeepEqual(expected, matches) {
+		t.Errorf("Expected %v got %v", expected, matches)
+	}
+}
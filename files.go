@@ -0,0 +1,304 @@
+package disgo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+func checksum(reader io.Reader) (string, error) {
+	hasher := sha256.New()
+	_, err := io.Copy(hasher, reader)
+	return hex.EncodeToString(hasher.Sum(nil)), err
+}
+
+// Record returns the stored information for the image at location
+func (db *DB) Record(location string) (ImageInfo, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.records.Get(location)
+}
+
+// SetTags replaces the tags on the record for location
+func (db *DB) SetTags(location string, tags ...string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	info, err := db.records.Get(location)
+	if err == nil {
+		info.Tags = tags
+		err = db.records.Put(info)
+	}
+
+	if err == nil {
+		err = db.log(walEntry{Op: walAdd, Info: &info})
+	}
+	return err
+}
+
+// AddPath adds the image file at path to the database and records its size,
+// modification time and checksum.  Files that are already recorded are only
+// decoded and hashed again if their content has changed
+func (db *DB) AddPath(path string) (info ImageInfo, err error) {
+	return db.AddPathContext(context.Background(), path)
+}
+
+// AddPathContext is like AddPath, but stops reading the file if ctx is
+// cancelled
+func (db *DB) AddPathContext(ctx context.Context, path string) (info ImageInfo, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	previous, err := db.Record(path)
+	found := err == nil
+	if err != nil && err != ErrNotFound {
+		return info, err
+	} else if found && previous.Size == stat.Size() && previous.ModTime.Equal(stat.ModTime()) {
+		return previous, nil
+	}
+
+	sum, err := checksum(&contextReader{ctx, file})
+	if err != nil {
+		return info, err
+	}
+
+	info = ImageInfo{
+		ID:       previous.ID,
+		Hash:     previous.Hash,
+		Location: path,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		Checksum: sum,
+		Width:    previous.Width,
+		Height:   previous.Height,
+		Tags:     previous.Tags,
+
+		LowInformation: previous.LowInformation,
+	}
+
+	if found && previous.Checksum == sum {
+		return db.putRecord(info)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return info, err
+	}
+
+	img, err := decode(ctx, file)
+	if err == nil {
+		info.Width = img.Bounds().Dx()
+		info.Height = img.Bounds().Dy()
+		info.LowInformation = LowInformation(img)
+		info.Hash, err = db.hasher(img)
+	}
+
+	if err == nil {
+		info, err = db.putRecord(info)
+	}
+	return info, err
+}
+
+// RemovePath deletes the record for path.  The image hash is removed from
+// the index once no other record refers to it
+func (db *DB) RemovePath(path string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	info, err := db.records.Get(path)
+	if err != nil {
+		return err
+	}
+	return db.removeRecord(info)
+}
+
+// RecordByID returns the stored information for the image with the given ID
+func (db *DB) RecordByID(id uint64) (ImageInfo, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.records.ID(id)
+}
+
+// RemoveID deletes the record of the image with the given ID
+func (db *DB) RemoveID(id uint64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	info, err := db.records.ID(id)
+	if err == nil {
+		err = db.removeRecord(info)
+	}
+	return err
+}
+
+// putRecord replaces the record at info.Location with info, which keeps
+// the previous record's ID unless it has its own
+func (db *DB) putRecord(info ImageInfo) (ImageInfo, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.replaceRecord(info)
+}
+
+func (db *DB) replaceRecord(info ImageInfo) (ImageInfo, error) {
+	previous, err := db.records.Get(info.Location)
+	if err == nil {
+		if info.ID == 0 {
+			info.ID = previous.ID
+		}
+		err = db.removeRecord(previous)
+	} else if err == ErrNotFound {
+		err = nil
+	}
+
+	if err == nil {
+		info, err = db.addRecord(info)
+	}
+	return info, err
+}
+
+// addRecord stores info, giving it a new ID if it doesn't have one, and
+// inserts its hash into the index
+func (db *DB) addRecord(info ImageInfo) (ImageInfo, error) {
+	if info.ID == 0 {
+		db.nextID++
+		info.ID = db.nextID
+	} else if info.ID > db.nextID {
+		db.nextID = info.ID
+	}
+
+	var err error
+	if postings, ok := db.index.(PostingIndex); ok {
+		err = postings.InsertID(info.Hash, info.ID)
+	} else {
+		err = db.index.Insert(info.Hash)
+	}
+
+	if err == nil {
+		err = db.records.Put(info)
+	}
+
+	if err == nil {
+		err = db.log(walEntry{Op: walAdd, Info: &info})
+	}
+	return info, err
+}
+
+// removeRecord deletes info from the store, and one occurrence of its hash
+// from the index
+func (db *DB) removeRecord(info ImageInfo) error {
+	err := db.records.Delete(info.Location)
+	if err == nil {
+		err = db.unindex(info)
+	}
+
+	if err == nil {
+		err = db.log(walEntry{Op: walRemove, Info: &info})
+	}
+	return err
+}
+
+// unindex removes one occurrence of info's hash from the index
+func (db *DB) unindex(info ImageInfo) error {
+	if postings, ok := db.index.(PostingIndex); ok {
+		return postings.RemoveID(info.Hash, info.ID)
+	}
+	return db.index.Remove(info.Hash)
+}
+
+// ScanError is returned by Scan when some of the image files it found
+// could not be added, such as files that fail to decode.  The rest of the
+// tree is still scanned
+type ScanError struct {
+	Files []*os.PathError
+}
+
+func (e *ScanError) Error() string {
+	if len(e.Files) == 1 {
+		return e.Files[0].Error()
+	}
+	return fmt.Sprintf("%v (and %d more files)", e.Files[0], len(e.Files)-1)
+}
+
+// Scan walks the directory tree rooted at root and adds every image file
+// found with AddPath, so only new or changed files are hashed.  Records for
+// files under root that no longer exist are removed.  Files that can't be
+// added don't stop the scan; they are returned in a *ScanError, and keep
+// any record they already had
+func (db *DB) Scan(root string) error {
+	return db.ScanContext(context.Background(), root)
+}
+
+// ScanContext is like Scan, but stops if ctx is cancelled.  Records of
+// missing files are only removed if the whole tree was scanned
+func (db *DB) ScanContext(ctx context.Context, root string) error {
+	root = filepath.Clean(root)
+	seen := make(map[string]bool)
+	scanErr := &ScanError{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			err = ctx.Err()
+		}
+
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		if _, err := imaging.FormatFromFilename(path); err != nil {
+			return nil
+		}
+
+		seen[path] = true
+		if _, err := db.AddPathContext(ctx, path); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			scanErr.Files = append(scanErr.Files, &os.PathError{Op: "scan", Path: path, Err: err})
+		}
+		return nil
+	})
+
+	if err == nil {
+		err = db.removeUnder(root, seen)
+	}
+
+	if err == nil && len(scanErr.Files) > 0 {
+		err = scanErr
+	}
+	return err
+}
+
+// removeUnder removes the record for root and for every location beneath
+// it, except for those in keep
+func (db *DB) removeUnder(root string, keep map[string]bool) (err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	prefix := strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator)
+	var removed []ImageInfo
+	err = db.records.Walk(func(info ImageInfo) error {
+		location := info.Location
+		if !keep[location] && (location == root || strings.HasPrefix(location, prefix)) {
+			removed = append(removed, info)
+		}
+		return nil
+	})
+
+	for _, info := range removed {
+		if err == nil {
+			err = db.removeRecord(info)
+		}
+	}
+	return err
+}
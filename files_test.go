@@ -0,0 +1,272 @@
+package disgo
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeTestImage writes a PNG that hashes differently for each row in rows
+func writeTestImage(t *testing.T, path string, rows uint8) {
+	img := image.NewGray(image.Rect(0, 0, 9, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			if rows&(0x80>>uint(y)) != 0 {
+				img.SetGray(x, y, color.Gray{uint8(200 - 20*x)})
+			}
+		}
+	}
+
+	file, err := os.Create(path)
+	if err == nil {
+		err = png.Encode(file, img)
+		file.Close()
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to write test image: %v", err)
+	}
+}
+
+func newCountingDB() (*DB, *int) {
+	count := 0
+	db := NewDB(NewLinearIndex())
+	db.hasher = func(img image.Image) (PHash, error) {
+		count++
+		return Hash(img)
+	}
+	return db, &count
+}
+
+// failingStore is a MemoryStore that can't look up records by location
+type failingStore struct {
+	*MemoryStore
+}
+
+var errTestStore = errors.New("Store failed")
+
+func (failingStore) Get(string) (ImageInfo, error) { return ImageInfo{}, errTestStore }
+
+func TestDBAddPath(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.png")
+	writeTestImage(t, path, 0)
+
+	db, count := newCountingDB()
+	info, err := db.AddPath(path)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if info.Location != path || info.Size == 0 || info.Checksum == "" {
+		t.Errorf("Expected record for %s got %+v", path, info)
+	}
+
+	if !info.LowInformation {
+		t.Errorf("Expected blank image to be flagged as low information")
+	}
+
+	// unchanged files aren't hashed again
+	db.AddPath(path)
+	if *count != 1 {
+		t.Errorf("Expected 1 hash got %d", *count)
+	}
+
+	if err := db.SetTags(path, "holiday"); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+
+	// touched, but identical content
+	mtime := time.Now().Add(time.Hour)
+	os.Chtimes(path, mtime, mtime)
+	db.AddPath(path)
+	if *count != 1 {
+		t.Errorf("Expected 1 hash got %d", *count)
+	}
+
+	writeTestImage(t, path, 0x81)
+	updated, _ := db.AddPath(path)
+	if *count != 2 {
+		t.Errorf("Expected 2 hashes got %d", *count)
+	}
+
+	if updated.Checksum == info.Checksum {
+		t.Errorf("Expected checksum to change")
+	}
+
+	if updated.LowInformation {
+		t.Errorf("Expected updated image not to be flagged as low information")
+	}
+
+	if !reflect.DeepEqual([]string{"holiday"}, updated.Tags) {
+		t.Errorf("Expected tags to be kept got %v", updated.Tags)
+	}
+
+	if err := db.SetTags("missing.png"); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	if matches, _ := db.SearchByHash(info.Hash, 0); len(matches) != 0 {
+		t.Errorf("Expected previous hash to be removed got %v", matches)
+	}
+
+	// only missing records are hashed, other store errors are returned
+	db, count = newCountingDB()
+	db.records = failingStore{NewMemoryStore()}
+	if _, err := db.AddPath(path); err != errTestStore {
+		t.Errorf("Expected %v got %v", errTestStore, err)
+	}
+
+	if *count != 0 {
+		t.Errorf("Expected 0 hashes got %d", *count)
+	}
+}
+
+func TestDBRemovePath(t *testing.T) {
+	db := NewDB(NewLinearIndex())
+	db.addRecord(ImageInfo{Hash: 0x42, Location: "a.png"})
+	db.addRecord(ImageInfo{Hash: 0x42, Location: "b.png"})
+
+	db.SearchFunc(0x42, 0, func(match Match) bool {
+		if match.Count != 2 {
+			t.Errorf("Expected 2 got %v", match.Count)
+		}
+		return true
+	})
+
+	if err := db.RemovePath("c.png"); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	db.RemovePath("a.png")
+	if matches, _ := db.SearchByHash(0x42, 0); len(matches) != 1 {
+		t.Errorf("Expected hash to remain while referenced got %v", matches)
+	}
+
+	db.RemovePath("b.png")
+	if matches, _ := db.SearchByHash(0x42, 0); len(matches) != 0 {
+		t.Errorf("Expected hash to be removed got %v", matches)
+	}
+}
+
+func TestDBRecordIDs(t *testing.T) {
+	db := New()
+	a, _ := db.addRecord(ImageInfo{Hash: 0x42, Location: "a.png"})
+	b, _ := db.addRecord(ImageInfo{Hash: 0x42, Location: "b.png"})
+	db.addRecord(ImageInfo{Hash: 0x43, Location: "c.png"})
+	if a.ID != 1 || b.ID != 2 {
+		t.Errorf("Expected IDs 1 and 2 got %d and %d", a.ID, b.ID)
+	}
+
+	// replacing a record keeps its ID
+	if info, _ := db.putRecord(ImageInfo{Hash: 0x44, Location: "a.png"}); info.ID != 1 {
+		t.Errorf("Expected 1 got %d", info.ID)
+	}
+
+	if info, err := db.RecordByID(1); err != nil || info.Hash != 0x44 {
+		t.Errorf("Expected the record for a.png got %v (%v)", info, err)
+	}
+
+	buf, _ := db.MarshalBinary()
+	loaded := New()
+	if err := loaded.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	// indexes without posting lists find the IDs in the record store
+	compact := NewDB(loaded.index.(*RadixIndex).Compact())
+	compact.records = loaded.records
+	for _, db := range []*DB{db, loaded, compact} {
+		ids, err := db.SearchIDs(context.Background(), 0x42, 1)
+		if expected := []uint64{2, 3}; err != nil || !reflect.DeepEqual(expected, ids) {
+			t.Errorf("%T expected %v got %v (%v)", db.index, expected, ids, err)
+		}
+	}
+
+	if err := loaded.RemoveID(2); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+
+	if _, err := loaded.RecordByID(2); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	if err := loaded.RemoveID(2); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	if info, _ := loaded.addRecord(ImageInfo{Hash: 0x45, Location: "d.png"}); info.ID != 4 {
+		t.Errorf("Expected 4 got %d", info.ID)
+	}
+}
+
+func TestDBScan(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeTestImage(t, filepath.Join(dir, "a.png"), 0)
+	writeTestImage(t, filepath.Join(dir, "sub", "b.png"), 0x81)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644)
+
+	db, count := newCountingDB()
+	db.addRecord(ImageInfo{Hash: 0x42, Location: "elsewhere.png"})
+	if err := db.Scan(dir); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	os.Remove(filepath.Join(dir, "a.png"))
+	if err := db.Scan(dir); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if *count != 2 {
+		t.Errorf("Expected 2 hashes got %d", *count)
+	}
+
+	var locations []string
+	for location := range testRecords(db) {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+
+	expected := []string{"elsewhere.png", filepath.Join(dir, "sub", "b.png")}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(expected, locations) {
+		t.Errorf("Expected %v got %v", expected, locations)
+	}
+
+	// a file that fails to decode doesn't stop the rest of the scan
+	bad := filepath.Join(dir, "bad.png")
+	ioutil.WriteFile(bad, []byte("not a png"), 0644)
+	writeTestImage(t, filepath.Join(dir, "c.png"), 0x18)
+	os.Remove(filepath.Join(dir, "sub", "b.png"))
+
+	err := db.Scan(dir)
+	if scanErr, ok := err.(*ScanError); !ok || len(scanErr.Files) != 1 || scanErr.Files[0].Path != bad {
+		t.Fatalf("Expected a ScanError for %s got %v", bad, err)
+	}
+
+	locations = nil
+	for location := range testRecords(db) {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+
+	expected = []string{"elsewhere.png", filepath.Join(dir, "c.png")}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(expected, locations) {
+		t.Errorf("Expected %v got %v", expected, locations)
+	}
+}
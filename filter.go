@@ -0,0 +1,150 @@
+package disgo
+
+import (
+	"context"
+	"strings"
+)
+
+// Filter selects the records that a filtered search returns
+type Filter func(ImageInfo) bool
+
+// FilterPrefix selects records whose location starts with prefix
+func FilterPrefix(prefix string) Filter {
+	return func(info ImageInfo) bool { return strings.HasPrefix(info.Location, prefix) }
+}
+
+// FilterTags selects records that have all of the tags
+func FilterTags(tags ...string) Filter {
+	return func(info ImageInfo) bool {
+		for _, tag := range tags {
+			found := false
+			for _, t := range info.Tags {
+				if t == tag {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// FilterMinSize selects images that are at least width by height pixels
+func FilterMinSize(width, height int) Filter {
+	return func(info ImageInfo) bool { return info.Width >= width && info.Height >= height }
+}
+
+// FilterInformative selects images that aren't flagged as LowInformation
+func FilterInformative(info ImageInfo) bool { return !info.LowInformation }
+
+// FilterAll selects records that pass every one of the filters
+func FilterAll(filters ...Filter) Filter {
+	return func(info ImageInfo) bool {
+		for _, filter := range filters {
+			if !filter(info) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// SearchByHashFilter is like SearchByHash, but only returns hashes with at
+// least one record selected by filter.  Hashes that were added without a
+// record are never selected
+func (db *DB) SearchByHashFilter(hash PHash, maxDistance int, filter Filter) ([]PHash, error) {
+	return db.SearchByHashFilterContext(context.Background(), hash, maxDistance, filter)
+}
+
+func (db *DB) SearchByHashFilterContext(ctx context.Context, hash PHash, maxDistance int, filter Filter) ([]PHash, error) {
+	var matches []PHash
+	err := db.SearchFuncFilterContext(ctx, hash, maxDistance, filter, func(match Match) bool {
+		matches = append(matches, match.Hash)
+		return true
+	})
+	return matches, err
+}
+
+// SearchFuncFilterContext is like SearchFuncContext, but only calls fn for
+// matches with at least one record selected by filter.  The Count and IDs
+// of those matches only cover the selected records.  Filtering doesn't
+// prune the search: every match within maxDistance is found first, and
+// their records are then looked up together (in one call to Hashes if the
+// store is a HashesStore) and filtered
+func (db *DB) SearchFuncFilterContext(ctx context.Context, hash PHash, maxDistance int, filter Filter, fn func(Match) bool) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var matches []Match
+	err := db.index.SearchFuncContext(ctx, hash, maxDistance, func(match Match) bool {
+		matches = append(matches, match)
+		return true
+	})
+
+	var records map[PHash][]ImageInfo
+	if err == nil && len(matches) > 0 {
+		records, err = db.recordsByHash(matches)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		selected := 0
+		ids := make(map[uint64]bool)
+		for _, info := range records[match.Hash] {
+			if filter(info) {
+				selected++
+				ids[info.ID] = true
+			}
+		}
+
+		if selected == 0 {
+			continue
+		}
+
+		var selectedIDs []uint64
+		for _, id := range match.IDs {
+			if ids[id] {
+				selectedIDs = append(selectedIDs, id)
+			}
+		}
+
+		match.Count, match.IDs = selected, selectedIDs
+		if !fn(match) {
+			break
+		}
+	}
+	return nil
+}
+
+// recordsByHash returns the records for the hashes of matches
+func (db *DB) recordsByHash(matches []Match) (map[PHash][]ImageInfo, error) {
+	byHash := make(map[PHash][]ImageInfo, len(matches))
+	if store, ok := db.records.(HashesStore); ok {
+		hashes := make([]PHash, len(matches))
+		for i, match := range matches {
+			hashes[i] = match.Hash
+		}
+
+		records, err := store.Hashes(hashes)
+		for _, info := range records {
+			byHash[info.Hash] = append(byHash[info.Hash], info)
+		}
+		return byHash, err
+	}
+
+	for _, match := range matches {
+		records, err := db.records.Hash(match.Hash)
+		if err != nil {
+			return nil, err
+		}
+		byHash[match.Hash] = records
+	}
+	return byHash, nil
+}
@@ -0,0 +1,85 @@
+package disgo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	info := ImageInfo{Location: "/photos/a.png", Width: 640, Height: 480, Tags: []string{"holiday", "beach"}}
+	tests := []struct {
+		filter   Filter
+		expected bool
+	}{
+		{FilterPrefix("/photos/"), true},
+		{FilterPrefix("/scans/"), false},
+		{FilterTags(), true},
+		{FilterTags("beach", "holiday"), true},
+		{FilterTags("beach", "work"), false},
+		{FilterMinSize(640, 480), true},
+		{FilterMinSize(641, 1), false},
+		{FilterAll(), true},
+		{FilterAll(FilterPrefix("/photos/"), FilterTags("beach")), true},
+		{FilterAll(FilterPrefix("/photos/"), FilterTags("work")), false},
+		{FilterInformative, true},
+		{SearchCriteria{ExcludeLowInformation: true}.Filter(), true},
+	}
+
+	for i, test := range tests {
+		if got := test.filter(info); got != test.expected {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestDBSearchByHashFilter(t *testing.T) {
+	db := New()
+	db.AddHash(0x00)
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "/photos/a.png", Width: 100, Height: 100})
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "/scans/b.png"})
+	db.addRecord(ImageInfo{Hash: 0x02, Location: "/scans/c.png", Tags: []string{"holiday"}})
+	db.addRecord(ImageInfo{Hash: 0x03, Location: "/photos/d.png", Tags: []string{"holiday"}})
+
+	tests := []struct {
+		filter   Filter
+		expected []PHash
+	}{
+		{FilterPrefix("/"), []PHash{0x01, 0x02, 0x03}},
+		{FilterPrefix("/scans/"), []PHash{0x01, 0x02}},
+		{FilterTags("holiday"), []PHash{0x02, 0x03}},
+		{FilterMinSize(50, 50), []PHash{0x01}},
+		{FilterPrefix("/elsewhere/"), nil},
+	}
+
+	for i, test := range tests {
+		matches, err := db.SearchByHashFilter(0x00, 64, test.filter)
+		if err != nil || !reflect.DeepEqual(test.expected, matches) {
+			t.Errorf("tests[%d] expected %v got %v (%v)", i, test.expected, matches, err)
+		}
+	}
+
+	// rejected matches don't count towards a page
+	criteria := SearchCriteria{Hash: 0x00, Distance: 64, SearchOptions: SearchOptions{Offset: 1, Limit: 1}, Prefix: "/photos/"}
+	matches, _ := db.SearchByCriteria(context.Background(), criteria)
+	if expected := []Match{{0x03, 2, 1, []uint64{4}}}; !reflect.DeepEqual(expected, matches) {
+		t.Errorf("Expected %v got %v", expected, matches)
+	}
+
+	// matches only count the records that were selected
+	var found []Match
+	db.AddHash(0x01)
+	db.SearchFuncFilterContext(context.Background(), 0x00, 64, FilterPrefix("/scans/"), func(match Match) bool {
+		found = append(found, match)
+		return true
+	})
+
+	expected := []Match{{0x01, 1, 1, []uint64{2}}, {0x02, 1, 1, []uint64{3}}}
+	if !reflect.DeepEqual(expected, found) {
+		t.Errorf("Expected %v got %v", expected, found)
+	}
+
+	if filter := (SearchCriteria{Hash: 0x42}).Filter(); filter != nil {
+		t.Errorf("Expected no filter")
+	}
+}
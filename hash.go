@@ -1,14 +1,40 @@
 package disgo
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"strconv"
+	"strings"
 
 	"github.com/disintegration/imaging"
 )
 
+var ErrInvalidHash = errors.New("Invalid hash")
+
+// PHash is a 64 bit perceptual hash.  Its text (and JSON) encoding is 16
+// lowercase hexadecimal digits
 type PHash uint64
 
+// ParsePHash parses up to 16 hexadecimal digits, with or without a 0x
+// prefix
+func ParsePHash(s string) (PHash, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+
+	if len(s) == 0 || len(s) > 16 || strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		return 0, ErrInvalidHash
+	}
+
+	hash, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, ErrInvalidHash
+	}
+	return PHash(hash), nil
+}
+
 func (p1 PHash) Distance(p2 PHash) (distance int) {
 	hamming := p1 ^ p2
 
@@ -46,10 +72,88 @@ func Hash(img image.Image) (PHash, error) {
 	return hash, nil
 }
 
+// MinVariance is the variance in intensity below which an image is
+// considered to have too little information to hash meaningfully
+var MinVariance = 16.0
+
+// Variance returns the variance of the intensity (0 to 255) of a 16x16
+// grayscale thumbnail of img.  Solid color and nearly blank images have a
+// variance close to zero
+func Variance(img image.Image) float64 {
+	size := 16
+	img = imaging.Grayscale(img)
+	img = imaging.Resize(img, size, size, imaging.Box)
+
+	var sum, squares float64
+	for row := 0; row < size; row++ {
+		for column := 0; column < size; column++ {
+			value := float64(intensity(img, row, column))
+			sum += value
+			squares += value * value
+		}
+	}
+
+	n := float64(size * size)
+	mean := sum / n
+	return squares/n - mean*mean
+}
+
+// LowInformation reports whether img is too uniform for its hash to tell
+// it apart from other images.  Hash gives every solid color image the same
+// hash, so they would otherwise all be reported as duplicates
+func LowInformation(img image.Image) bool {
+	return Variance(img) < MinVariance
+}
+
 func (h PHash) MarshalBinary() ([]byte, error) {
 	return []byte{byte(h >> 56), byte(h >> 48), byte(h >> 40), byte(h >> 32), byte(h >> 24), byte(h >> 16), byte(h >> 8), byte(h)}, nil
 }
 
+func (h *PHash) UnmarshalBinary(buf []byte) error {
+	if len(buf) != 8 {
+		return ErrInvalidHash
+	}
+
+	*h = 0
+	for _, b := range buf {
+		*h = *h<<8 | PHash(b)
+	}
+	return nil
+}
+
+func (h PHash) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%016x", uint64(h))), nil
+}
+
+func (h *PHash) UnmarshalText(text []byte) error {
+	hash, err := ParsePHash(string(text))
+	if err == nil {
+		*h = hash
+	}
+	return err
+}
+
+// UnmarshalJSON accepts the text encoding, and also the decimal numbers
+// that hashes were encoded as before they had one
+func (h *PHash) UnmarshalJSON(buf []byte) error {
+	if len(buf) > 0 && buf[0] == '"' {
+		var text string
+		if err := json.Unmarshal(buf, &text); err != nil {
+			return err
+		}
+		return h.UnmarshalText([]byte(text))
+	} else if string(buf) == "null" {
+		return nil
+	}
+
+	hash, err := strconv.ParseUint(string(buf), 10, 64)
+	if err != nil {
+		return ErrInvalidHash
+	}
+	*h = PHash(hash)
+	return nil
+}
+
 func (h PHash) String() string {
 	return fmt.Sprintf("0x%016x   %064b", uint64(h), uint64(h))
 }
@@ -1,8 +1,12 @@
 package disgo
 
 import (
+	"encoding/json"
 	"image"
+	"image/color"
 	"testing"
+
+	"github.com/disintegration/imaging"
 )
 
 func TestHashDistance(t *testing.T) {
@@ -102,3 +106,110 @@ func TestHash(t *testing.T) {
 		}
 	}
 }
+
+func TestLowInformation(t *testing.T) {
+	speck := imaging.New(64, 64, color.White)
+	speck.Set(10, 10, color.Black)
+
+	gradient := image.NewGray(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			gradient.SetGray(x, y, color.Gray{uint8(4 * x)})
+		}
+	}
+
+	tests := []struct {
+		img      image.Image
+		expected bool
+	}{
+		{imaging.New(64, 64, color.Black), true},
+		{imaging.New(64, 64, color.NRGBA{0x20, 0x80, 0xc0, 0xff}), true},
+		{speck, true},
+		{gradient, false},
+	}
+
+	for i, test := range tests {
+		if got := LowInformation(test.img); got != test.expected {
+			t.Errorf("tests[%d] expected %v got %v (variance %v)", i, test.expected, got, Variance(test.img))
+		}
+	}
+}
+
+func TestParsePHash(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected PHash
+		err      error
+	}{
+		{"00ff00ff00ff00ff", 0x00ff00ff00ff00ff, nil},
+		{"0x00FF00FF00FF00FF", 0x00ff00ff00ff00ff, nil},
+		{"ff", 0xff, nil},
+		{"ffffffffffffffff", 0xffffffffffffffff, nil},
+		{"", 0, ErrInvalidHash},
+		{"0x", 0, ErrInvalidHash},
+		{"1ffffffffffffffff", 0, ErrInvalidHash},
+		{"+ff", 0, ErrInvalidHash},
+		{"0xfg", 0, ErrInvalidHash},
+	}
+
+	for i, test := range tests {
+		hash, err := ParsePHash(test.input)
+		if hash != test.expected || err != test.err {
+			t.Errorf("tests[%d] expected %x (%v) got %x (%v)", i, test.expected, test.err, hash, err)
+		}
+	}
+}
+
+func TestPHashEncoding(t *testing.T) {
+	for i, hash := range []PHash{0, 0x42, 0x00ff00ff00ff00ff, 0xffffffffffffffff} {
+		var decoded PHash
+		buf, _ := hash.MarshalBinary()
+		if err := decoded.UnmarshalBinary(buf); err != nil || decoded != hash {
+			t.Errorf("tests[%d] expected %x got %x (%v)", i, hash, decoded, err)
+		}
+
+		text, _ := hash.MarshalText()
+		if len(text) != 16 {
+			t.Errorf("tests[%d] expected 16 digits got %q", i, text)
+		}
+
+		decoded = 0
+		if err := decoded.UnmarshalText(text); err != nil || decoded != hash {
+			t.Errorf("tests[%d] expected %x got %x (%v)", i, hash, decoded, err)
+		}
+
+		info := ImageInfo{Hash: hash}
+		buf, _ = json.Marshal(info)
+		var decodedInfo ImageInfo
+		if err := json.Unmarshal(buf, &decodedInfo); err != nil || decodedInfo.Hash != hash {
+			t.Errorf("tests[%d] expected %x got %x (%v)", i, hash, decodedInfo.Hash, err)
+		}
+	}
+
+	var hash PHash
+	if err := hash.UnmarshalBinary([]byte{1, 2, 3}); err != ErrInvalidHash {
+		t.Errorf("Expected %v got %v", ErrInvalidHash, err)
+	}
+
+	tests := []struct {
+		input    string
+		expected PHash
+		valid    bool
+	}{
+		{`{"hash":"00000000000000ff"}`, 0xff, true},
+		{`{"hash":255}`, 0xff, true},
+		{`{"hash":18446744073709551615}`, 0xffffffffffffffff, true},
+		{`{"hash":null}`, 0, true},
+		{`{"hash":"xyz"}`, 0, false},
+		{`{"hash":-1}`, 0, false},
+		{`{"hash":1.5}`, 0, false},
+	}
+
+	for i, test := range tests {
+		var criteria SearchCriteria
+		err := json.Unmarshal([]byte(test.input), &criteria)
+		if (err == nil) != test.valid || criteria.Hash != test.expected {
+			t.Errorf("tests[%d] expected %x (valid %v) got %x (%v)", i, test.expected, test.valid, criteria.Hash, err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package disgo
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrNoHashColumn = errors.New("CSV does not have a hash column")
+
+// Import adds the hashes and records in reader to the database.  Input
+// starting with '{' is read as JSON Lines (see ImportJSON), anything else
+// as CSV (see ImportCSV)
+func (db *DB) Import(reader io.Reader) error {
+	buffered := bufio.NewReader(reader)
+	for {
+		r, _, err := buffered.ReadRune()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !unicode.IsSpace(r) {
+			buffered.UnreadRune()
+			if r == '{' {
+				return db.ImportJSON(buffered)
+			}
+			return db.ImportCSV(buffered)
+		}
+	}
+}
+
+// importLine is a line of JSON Lines input, which is either an ImageInfo
+// or an ExportEntry
+type importLine struct {
+	ImageInfo
+	Count   int         `json:"count"`
+	Records []ImageInfo `json:"records"`
+}
+
+// ImportJSON reads JSON Lines, each of which is either an ImageInfo or an
+// ExportEntry (so the output of Export can be imported).  Lines with a hash
+// but no location or records add the hash without a record, count times
+func (db *DB) ImportJSON(reader io.Reader) error {
+	var records []ImageInfo
+	var hashes []PHash
+	decoder := json.NewDecoder(reader)
+	for {
+		var line importLine
+		err := decoder.Decode(&line)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if line.Location != "" {
+			line.Records = append(line.Records, line.ImageInfo)
+		}
+
+		extra := line.Count - len(line.Records)
+		if line.Count == 0 && len(line.Records) == 0 {
+			extra = 1
+		}
+
+		for i := 0; i < extra; i++ {
+			hashes = append(hashes, line.Hash)
+		}
+		records = append(records, line.Records...)
+	}
+	return db.importRecords(records, hashes)
+}
+
+// ImportCSV reads CSV whose first row names the columns.  The columns are
+// those of the ImageInfo JSON, in any order, and only hash is required.
+// Hashes are hexadecimal, mtime is RFC 3339 and tags are separated by
+// semicolons.  Other columns are ignored, so reports written by
+// WriteCSVReport can be imported.  Rows without a location add the hash
+// without a record
+func (db *DB) ImportCSV(reader io.Reader) error {
+	r := csv.NewReader(reader)
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	if _, found := columns["hash"]; !found {
+		return ErrNoHashColumn
+	}
+
+	var records []ImageInfo
+	var hashes []PHash
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		info, err := parseCSVRow(columns, row)
+		if err != nil {
+			return err
+		}
+
+		if info.Location == "" {
+			hashes = append(hashes, info.Hash)
+		} else {
+			records = append(records, info)
+		}
+	}
+	return db.importRecords(records, hashes)
+}
+
+// parseCSVRow parses the ImageInfo columns of row
+func parseCSVRow(columns map[string]int, row []string) (info ImageInfo, err error) {
+	field := func(name string) string {
+		if i, found := columns[name]; found && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	info.Hash, err = ParsePHash(field("hash"))
+	info.Location = field("location")
+	info.Checksum = field("checksum")
+	if tags := field("tags"); tags != "" {
+		info.Tags = strings.Split(tags, ";")
+	}
+
+	if value := field("id"); err == nil && value != "" {
+		info.ID, err = strconv.ParseUint(value, 10, 64)
+	}
+
+	if value := field("size"); err == nil && value != "" {
+		info.Size, err = strconv.ParseInt(value, 10, 64)
+	}
+
+	if value := field("width"); err == nil && value != "" {
+		info.Width, err = strconv.Atoi(value)
+	}
+
+	if value := field("height"); err == nil && value != "" {
+		info.Height, err = strconv.Atoi(value)
+	}
+
+	if value := field("mtime"); err == nil && value != "" {
+		info.ModTime, err = time.Parse(time.RFC3339, value)
+	}
+
+	if value := field("low_information"); err == nil && value != "" {
+		info.LowInformation, err = strconv.ParseBool(value)
+	}
+	return info, err
+}
+
+// importRecords adds the records, replacing any at the same locations, and
+// inserts their hashes along with the bare hashes in a single batch
+func (db *DB) importRecords(records []ImageInfo, hashes []PHash) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.importBatch(records, hashes)
+}
+
+// importBatch writes the records to the store and then inserts their
+// hashes and the bare hashes with one call to insert, logging the whole
+// batch as a single entry.  Records keep their IDs unless the ID already
+// belongs to a different location.  A PostingIndex needs each record's ID,
+// so its records are inserted with InsertID instead
+func (db *DB) importBatch(records []ImageInfo, hashes []PHash) error {
+	if len(records) == 0 && len(hashes) == 0 {
+		return nil
+	}
+
+	postings, hasPostings := db.index.(PostingIndex)
+	batch := append([]PHash(nil), hashes...)
+	for i, info := range records {
+		if other, err := db.records.ID(info.ID); err == nil && other.Location != info.Location {
+			info.ID = 0
+		}
+
+		previous, err := db.records.Get(info.Location)
+		if err == nil {
+			if info.ID == 0 {
+				info.ID = previous.ID
+			}
+			err = db.records.Delete(previous.Location)
+			if err == nil {
+				err = db.unindex(previous)
+			}
+		} else if err == ErrNotFound {
+			err = nil
+		}
+
+		if info.ID == 0 {
+			db.nextID++
+			info.ID = db.nextID
+		} else if info.ID > db.nextID {
+			db.nextID = info.ID
+		}
+
+		if err == nil {
+			err = db.records.Put(info)
+		}
+
+		if err == nil && hasPostings {
+			err = postings.InsertID(info.Hash, info.ID)
+		} else if err == nil {
+			batch = append(batch, info.Hash)
+		}
+
+		if err != nil {
+			return err
+		}
+		records[i] = info
+	}
+
+	err := db.insert(batch)
+	if err == nil {
+		err = db.log(walEntry{Op: walImport, Records: records, Hashes: hashes})
+	}
+	return err
+}
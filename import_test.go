@@ -0,0 +1,135 @@
+package disgo
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDBImportExport(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "a.png", Tags: []string{"x"}})
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "b.png", LowInformation: true})
+	db.AddHash(0x01)
+	db.AddHash(0x02)
+
+	exported := bytes.NewBuffer(nil)
+	db.Export(exported)
+
+	imported := New()
+	if err := imported.Import(bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	imported.Export(buf)
+	if buf.String() != exported.String() {
+		t.Errorf("Expected %s got %s", exported.String(), buf.String())
+	}
+
+	if !reflect.DeepEqual(testRecords(db), testRecords(imported)) {
+		t.Errorf("Expected %v got %v", testRecords(db), testRecords(imported))
+	}
+}
+
+func TestDBImportJSON(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x05, Location: "x.png"})
+
+	input := `{"id":1,"hash":1,"location":"a.png","width":3}
+{"hash":2}
+
+{"hash":3,"count":2}
+`
+	if err := db.Import(strings.NewReader(input)); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	// the ID of x.png is kept, so a.png gets a new one
+	expected := map[string]ImageInfo{
+		"x.png": {ID: 1, Hash: 0x05, Location: "x.png"},
+		"a.png": {ID: 2, Hash: 0x01, Location: "a.png", Width: 3},
+	}
+
+	if records := testRecords(db); !reflect.DeepEqual(expected, records) {
+		t.Errorf("Expected %v got %v", expected, records)
+	}
+
+	var counts []int
+	db.Walk(func(match Match) bool {
+		counts = append(counts, match.Count)
+		return true
+	})
+
+	if expected := []int{1, 1, 2, 1}; !reflect.DeepEqual(expected, counts) {
+		t.Errorf("Expected %v got %v", expected, counts)
+	}
+
+	if err := db.ImportJSON(strings.NewReader(`{"hash":`)); err == nil {
+		t.Errorf("Expected an error for truncated input")
+	}
+}
+
+func TestDBImportCSV(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		input    string
+		expected map[string]ImageInfo
+		hashes   []PHash
+		err      error
+	}{
+		{
+			"hash,location\n0x0a,a.png\nff,\n",
+			map[string]ImageInfo{"a.png": {ID: 1, Hash: 0x0a, Location: "a.png"}},
+			[]PHash{0x0a, 0xff},
+			nil,
+		},
+		{
+			" Location , Hash ,size,width,height,mtime,checksum,tags,low_information,id\nb.png,1,10,3,4,2020-01-02T03:04:05Z,abcd,x;y,true,7\n",
+			map[string]ImageInfo{"b.png": {ID: 7, Hash: 0x01, Location: "b.png", Size: 10, Width: 3, Height: 4, ModTime: mtime, Checksum: "abcd", Tags: []string{"x", "y"}, LowInformation: true}},
+			[]PHash{0x01},
+			nil,
+		},
+		{"location\na.png\n", map[string]ImageInfo{}, nil, ErrNoHashColumn},
+		{"", map[string]ImageInfo{}, nil, nil},
+	}
+
+	for i, test := range tests {
+		db := New()
+		err := db.Import(strings.NewReader(test.input))
+		if err != test.err {
+			t.Errorf("tests[%d] expected %v got %v", i, test.err, err)
+		}
+
+		if records := testRecords(db); !reflect.DeepEqual(test.expected, records) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, records)
+		}
+
+		if hashes, _ := db.SearchByHash(0, 64); !reflect.DeepEqual(test.hashes, hashes) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.hashes, hashes)
+		}
+	}
+
+	if err := New().ImportCSV(strings.NewReader("hash\nxyz\n")); err == nil {
+		t.Errorf("Expected an error for an invalid hash")
+	}
+
+	// CSV reports can be imported
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "a.png", Size: 3})
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "b.png"})
+	groups, _ := db.FindDuplicates(0, GroupComponents)
+	buf := bytes.NewBuffer(nil)
+	WriteCSVReport(buf, groups)
+
+	imported := New()
+	if err := imported.ImportCSV(buf); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if !reflect.DeepEqual(testRecords(db), testRecords(imported)) {
+		t.Errorf("Expected %v got %v", testRecords(db), testRecords(imported))
+	}
+}
@@ -1,31 +1,90 @@
 package disgo
 
+import "context"
+
+// LinearIndex maps each hash to the number of times it has been inserted
 type LinearIndex struct {
-	entries map[PHash]bool
+	entries  map[PHash]int
+	postings postings
 }
 
 func NewLinearIndex() *LinearIndex {
 	li := new(LinearIndex)
-	li.entries = make(map[PHash]bool)
+	li.entries = make(map[PHash]int)
+	li.postings = make(postings)
 	return li
 }
 
 func (li *LinearIndex) Insert(phash PHash) error {
-	li.entries[phash] = true
+	li.entries[phash]++
+	return nil
+}
+
+func (li *LinearIndex) Remove(phash PHash) error {
+	count, found := li.entries[phash]
+	if !found {
+		return ErrNotFound
+	}
+
+	if count > 1 {
+		li.entries[phash] = count - 1
+	} else {
+		delete(li.entries, phash)
+	}
 	return nil
 }
 
 func (li *LinearIndex) Search(phash PHash, maxDistance int) ([]PHash, error) {
+	return li.SearchContext(context.Background(), phash, maxDistance)
+}
+
+func (li *LinearIndex) SearchContext(ctx context.Context, phash PHash, maxDistance int) ([]PHash, error) {
 	var results []PHash
+	err := li.SearchFuncContext(ctx, phash, maxDistance, func(match Match) bool {
+		results = append(results, match.Hash)
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SearchFunc calls fn for each hash within maxDistance of phash until fn
+// returns false.  The hashes are not visited in any particular order
+func (li *LinearIndex) SearchFunc(phash PHash, maxDistance int, fn func(Match) bool) error {
+	return li.SearchFuncContext(context.Background(), phash, maxDistance, fn)
+}
+
+func (li *LinearIndex) SearchFuncContext(ctx context.Context, phash PHash, maxDistance int, fn func(Match) bool) error {
+	sc := &searchContext{ctx: ctx}
 
 	// look for existing entry within maxDistance of the hash
-	for p := range li.entries {
-		if p.Distance(phash) <= maxDistance {
-			results = append(results, p)
+	for p, count := range li.entries {
+		if sc.cancelled() {
+			return sc.err
+		}
+
+		if distance := p.Distance(phash); distance <= maxDistance {
+			if !fn(Match{Hash: p, Distance: distance, Count: count, IDs: li.postings.ids(p)}) {
+				break
+			}
 		}
 	}
+	return nil
+}
 
-	return results, nil
+func (li *LinearIndex) Pairs(maxDistance int) ([]Pair, error) {
+	var pairs []Pair
+	for p1 := range li.entries {
+		for p2 := range li.entries {
+			if p1 < p2 && p1.Distance(p2) <= maxDistance {
+				pairs = append(pairs, Pair{Hash1: p1, Hash2: p2, Distance: p1.Distance(p2)})
+			}
+		}
+	}
+	return pairs, nil
 }
 
 func (li *LinearIndex) MarshalBinary() ([]byte, error) {
@@ -0,0 +1,147 @@
+package disgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+)
+
+// mappedMagic starts every file written by SaveMapped.  It is followed by
+// the length of the node section and the length of the record section
+// (both uint64, little endian), the nodes in the CompactRadixIndex layout
+// and then the records as a JSON array
+var mappedMagic = []byte("disgomap")
+
+const mappedHeaderSize = 24
+
+// compacter is implemented by indexes that can be converted to the
+// CompactRadixIndex layout
+type compacter interface {
+	Compact() *CompactRadixIndex
+}
+
+// SaveMapped writes the database to path in a layout that can be searched
+// in place by OpenMapped.  The file is written and synced the same way as
+// SaveFile, so processes that already have path mapped are not affected.
+// Only radix indexes can be saved this way, and the layout has no room for
+// collections; any other index, or a database with collections, returns
+// ErrNotSupported
+func (db *DB) SaveMapped(path string) error {
+	db.mutex.RLock()
+	index, ok := db.index.(compacter)
+	if !ok || len(db.collections) > 0 {
+		db.mutex.RUnlock()
+		return ErrNotSupported
+	}
+
+	nodes := index.Compact().nodes
+	records, err := db.marshalRecords()
+	db.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, mappedHeaderSize, mappedHeaderSize+len(nodes)+len(records))
+	copy(buf, mappedMagic)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(nodes)))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(len(records)))
+	buf = append(append(buf, nodes...), records...)
+	return writeFile(path, buf, 0)
+}
+
+// MappedIndex is a CompactRadixIndex that is searched directly from a
+// memory mapped file written by DB.SaveMapped.  Opening one doesn't decode
+// anything, and processes that map the same file share its pages.  Like
+// CompactRadixIndex it is read only
+type MappedIndex struct {
+	CompactRadixIndex
+	data    []byte
+	records []byte
+}
+
+// OpenMappedIndex maps the file at path.  The nodes are checked in a
+// single pass over the mapping, without decoding them, and ErrCorrupt is
+// returned if they don't form a valid tree.  The index must be closed when
+// it is no longer needed, and must not be searched after that
+func OpenMappedIndex(path string) (*MappedIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Size() < mappedHeaderSize {
+		return nil, ErrCorrupt
+	}
+
+	data, err := mmap(file, int(stat.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	mi := &MappedIndex{data: data}
+	if err = mi.parse(); err != nil {
+		munmap(data)
+		return nil, err
+	}
+	return mi, nil
+}
+
+func (mi *MappedIndex) parse() error {
+	if !bytes.HasPrefix(mi.data, mappedMagic) {
+		return ErrCorrupt
+	}
+
+	nodeLen := binary.LittleEndian.Uint64(mi.data[8:])
+	recordLen := binary.LittleEndian.Uint64(mi.data[16:])
+	buf := mi.data[mappedHeaderSize:]
+	if nodeLen%compactNodeSize != 0 || nodeLen > uint64(len(buf)) || recordLen != uint64(len(buf))-nodeLen {
+		return ErrCorrupt
+	}
+
+	mi.nodes = buf[:nodeLen]
+	mi.records = buf[nodeLen:]
+	return mi.validate()
+}
+
+// UnmarshalBinary always returns ErrReadOnly, a MappedIndex can only be
+// loaded from a file
+func (mi *MappedIndex) UnmarshalBinary([]byte) error { return ErrReadOnly }
+
+// Close unmaps the file
+func (mi *MappedIndex) Close() error {
+	if mi.data == nil {
+		return nil
+	}
+
+	err := munmap(mi.data)
+	mi.data, mi.nodes, mi.records = nil, nil, nil
+	return err
+}
+
+// OpenMapped opens a database written by SaveMapped.  Searches run against
+// the mapped file, but the records are decoded into memory.  The database
+// is read only and must be closed when it is no longer needed
+func OpenMapped(path string) (*DB, error) {
+	index, err := OpenMappedIndex(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db := NewDB(index)
+	err = db.unmarshalRecords(index.records)
+	if err == nil {
+		err = db.indexRecords(true)
+	}
+
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,117 @@
+package disgo
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDBSaveMapped(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	index := newTestRadixIndex(1000)
+	db := NewDB(index)
+	db.addRecord(ImageInfo{Hash: 0x42, Location: "a.png", Size: 37, Checksum: "abcd"})
+
+	path := filepath.Join(dir, "test.idx")
+	if err := db.SaveMapped(path); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	mapped, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if !reflect.DeepEqual(testRecords(db), testRecords(mapped)) {
+		t.Errorf("Expected %v got %v", testRecords(db), testRecords(mapped))
+	}
+
+	for _, query := range append(benchmarkHashes(1000)[:20], 0x42) {
+		expected, _ := db.SearchByHash(query, 5)
+		matches, _ := mapped.SearchByHash(query, 5)
+		if !reflect.DeepEqual(expected, matches) {
+			t.Errorf("%v expected %v got %v", query, expected, matches)
+		}
+	}
+
+	if err := mapped.AddHash(0x37); err != ErrReadOnly {
+		t.Errorf("Expected %v got %v", ErrReadOnly, err)
+	}
+
+	// saving over a mapped file leaves the open mapping intact
+	if err := NewDB(NewRadixIndex()).SaveMapped(path); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if matches, _ := mapped.SearchByHash(0x42, 0); len(matches) != 1 {
+		t.Errorf("Expected 1 match got %v", matches)
+	}
+
+	if empty, err := OpenMappedIndex(path); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	} else {
+		empty.Close()
+	}
+
+	if err := mapped.Close(); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+
+	if err := NewDB(NewLinearIndex()).SaveMapped(path); err != ErrNotSupported {
+		t.Errorf("Expected %v got %v", ErrNotSupported, err)
+	}
+
+	withCollection := NewDB(NewRadixIndex())
+	withCollection.Collection("photos")
+	if err := withCollection.SaveMapped(path); err != ErrNotSupported {
+		t.Errorf("Expected %v got %v", ErrNotSupported, err)
+	}
+}
+
+func TestOpenMappedIndexCorrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.idx")
+	NewDB(newTestRadixIndex(100)).SaveMapped(path)
+	buf, _ := ioutil.ReadFile(path)
+
+	// the root must have both children for the patches below
+	if flags := nodeFlags(buf[mappedHeaderSize+13]); !flags.HasLeft() || !flags.HasRight() {
+		t.Fatalf("Expected the root to have two children")
+	}
+
+	// patch returns a copy of buf with node i changed by fn
+	patch := func(i int, fn func(node []byte)) []byte {
+		patched := append([]byte(nil), buf...)
+		offset := mappedHeaderSize + i*compactNodeSize
+		fn(patched[offset : offset+compactNodeSize])
+		return patched
+	}
+
+	tests := [][]byte{
+		buf[:mappedHeaderSize-1],
+		buf[:len(buf)-1],
+		append([]byte("notmagic"), buf[8:]...),
+		// right children out of range and pointing backwards
+		patch(0, func(node []byte) { binary.LittleEndian.PutUint32(node[8:], 0xffffffff) }),
+		patch(0, func(node []byte) { binary.LittleEndian.PutUint32(node[8:], 0) }),
+		// a leaf that claims to have children, and an unknown flag
+		patch(1, func(node []byte) { node[13] = 0xc0; node[12] = 64 }),
+		patch(1, func(node []byte) { node[13] |= 0x01 }),
+		// an internal node without any prefix
+		patch(1, func(node []byte) { node[12] = 0 }),
+	}
+
+	for i, test := range tests {
+		ioutil.WriteFile(path, test, 0644)
+		if _, err := OpenMappedIndex(path); err != ErrCorrupt {
+			t.Errorf("tests[%d] expected %v got %v", i, ErrCorrupt, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package disgo
+
+import "sort"
+
+// Merge adds every hash in other to ri, as if each had been inserted again
+// as many times as it is in other.  The trees are merged structurally:
+// subtrees only other has are copied over whole and shared prefixes are
+// walked once.  For two indexes of 10,000 hashes that is a little faster
+// than inserting other's hashes with InsertBatch (see
+// BenchmarkRadixIndexMerge10000), and it needs no list of the hashes.
+// other's posting lists are not merged, since its IDs refer to other
+// records; the merged hashes have no IDs in ri.  other is not modified
+func (ri *RadixIndex) Merge(other *RadixIndex) error {
+	root, ok := ri.root.(*Node)
+	otherRoot, otherOk := other.root.(*Node)
+	if !ok || !otherOk {
+		return other.Walk(func(match Match) bool {
+			for i := 0; i < match.Count; i++ {
+				ri.Insert(match.Hash)
+			}
+			return true
+		})
+	}
+
+	if ri == other {
+		otherRoot = otherRoot.clone()
+	}
+	root.merge(otherRoot)
+	return nil
+}
+
+// clone returns a deep copy of the subtree at n
+func (n *Node) clone() *Node {
+	if n == nil {
+		return nil
+	}
+
+	c := *n
+	c.left = n.left.clone()
+	c.right = n.right.clone()
+	return &c
+}
+
+// merge adds the hashes in the subtree at other to the subtree at n.  Both
+// subtrees must start at the same depth.  other is only read; the parts of
+// it that n doesn't have are copied
+func (n *Node) merge(other *Node) {
+	if other.length == 0 && other.IsLeaf() {
+		return
+	} else if n.length == 0 && n.IsLeaf() {
+		*n = *other.clone()
+		return
+	}
+
+	matchLength := n.Match(other.prefix)
+	if other.length < matchLength {
+		matchLength = other.length
+	}
+
+	if n.length > matchLength {
+		newNode := &Node{
+			prefix:     n.prefix << matchLength,
+			length:     n.length - matchLength,
+			left:       n.left,
+			right:      n.right,
+			duplicates: n.duplicates,
+		}
+
+		n.duplicates = 0
+		n.length = matchLength
+		n.prefix = n.prefix & bitmasks[matchLength]
+		n.left, n.right = nil, nil
+		if newNode.prefix&bitmasks[1] == 0 {
+			n.left = newNode
+		} else {
+			n.right = newNode
+		}
+	}
+
+	if other.length == matchLength {
+		if n.IsLeaf() {
+			n.duplicates += other.duplicates + 1
+			return
+		}
+		mergeChild(&n.left, other.left)
+		mergeChild(&n.right, other.right)
+		return
+	}
+
+	rest := &Node{
+		prefix:     other.prefix << matchLength,
+		length:     other.length - matchLength,
+		left:       other.left,
+		right:      other.right,
+		duplicates: other.duplicates,
+	}
+
+	if rest.prefix&bitmasks[1] == 0 {
+		mergeChild(&n.left, rest)
+	} else {
+		mergeChild(&n.right, rest)
+	}
+}
+
+// mergeChild merges other into the child of a node, copying it if there
+// is no child yet
+func mergeChild(child **Node, other *Node) {
+	if other == nil {
+		return
+	} else if *child == nil {
+		*child = other.clone()
+	} else {
+		(*child).merge(other)
+	}
+}
+
+// Diff returns the hashes that are only in ri and those that are only in
+// other, both in ascending order.  How many times a hash was inserted
+// doesn't matter, only whether it is there at all
+func (ri *RadixIndex) Diff(other *RadixIndex) (onlyIndex, onlyOther []PHash, err error) {
+	hashes, err := walkHashes(ri)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	otherHashes, err := walkHashes(other)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i, j := 0, 0
+	for i < len(hashes) && j < len(otherHashes) {
+		switch {
+		case hashes[i] < otherHashes[j]:
+			onlyIndex = append(onlyIndex, hashes[i])
+			i++
+		case hashes[i] > otherHashes[j]:
+			onlyOther = append(onlyOther, otherHashes[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	onlyIndex = append(onlyIndex, hashes[i:]...)
+	onlyOther = append(onlyOther, otherHashes[j:]...)
+	return onlyIndex, onlyOther, nil
+}
+
+// walkHashes returns the distinct hashes of walker in the order walked
+func walkHashes(walker Walker) (hashes []PHash, err error) {
+	err = walker.Walk(func(match Match) bool {
+		hashes = append(hashes, match.Hash)
+		return true
+	})
+	return hashes, err
+}
+
+// Merge adds the hashes and records of other, and of its collections, to
+// the database.  Records replace any at the same location, keeping that
+// record's ID, and otherwise get new IDs since other's IDs mean nothing
+// here.  When both indexes are RadixIndexes the hashes other holds without
+// a record are merged in with RadixIndex.Merge.  other is only read
+func (db *DB) Merge(other *DB) error {
+	other.mutex.RLock()
+	var records []ImageInfo
+	err := other.records.Walk(func(info ImageInfo) error {
+		info.ID = 0
+		records = append(records, info)
+		return nil
+	})
+
+	var bare *RadixIndex
+	if err == nil {
+		bare, err = other.unrecordedIndex(records)
+	}
+
+	collections := make(map[string]*DB, len(other.collections))
+	for name, collection := range other.collections {
+		collections[name] = collection
+	}
+	other.mutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	// new IDs are handed out in location order, not the store's
+	sort.Slice(records, func(i, j int) bool { return records[i].Location < records[j].Location })
+	err = db.importRecords(records, nil)
+	if err == nil {
+		err = db.mergeIndex(bare)
+	}
+
+	for name, collection := range collections {
+		if err != nil {
+			break
+		}
+		err = db.Collection(name).Merge(collection)
+	}
+	return err
+}
+
+// unrecordedIndex returns a RadixIndex of the hashes in db that don't
+// belong to one of its records.  A RadixIndex is copied and the records'
+// hashes removed from the copy, other indexes are walked
+func (db *DB) unrecordedIndex(records []ImageInfo) (*RadixIndex, error) {
+	bare := NewRadixIndex()
+	if ri, ok := db.index.(*RadixIndex); ok {
+		if err := bare.Merge(ri); err != nil {
+			return nil, err
+		}
+
+		for _, info := range records {
+			if err := bare.Remove(info.Hash); err != nil && err != ErrNotFound {
+				return nil, err
+			}
+		}
+		return bare, nil
+	}
+
+	recorded := make(map[PHash]int)
+	for _, info := range records {
+		recorded[info.Hash]++
+	}
+
+	var hashes []PHash
+	err := db.walk(func(match Match) bool {
+		for i := recorded[match.Hash]; i < match.Count; i++ {
+			hashes = append(hashes, match.Hash)
+		}
+		return true
+	})
+	if err == nil {
+		err = bare.InsertBatch(hashes)
+	}
+	return bare, err
+}
+
+// mergeIndex adds the hashes in bare to the database without records.  The
+// hashes are only listed if the index isn't a RadixIndex or they need to
+// be logged
+func (db *DB) mergeIndex(bare *RadixIndex) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var hashes []PHash
+	var err error
+	ri, merge := db.index.(*RadixIndex)
+	if !merge || db.wal != nil {
+		err = bare.Walk(func(match Match) bool {
+			for i := 0; i < match.Count; i++ {
+				hashes = append(hashes, match.Hash)
+			}
+			return true
+		})
+	}
+
+	if err != nil {
+		return err
+	} else if merge {
+		err = ri.Merge(bare)
+	} else {
+		err = db.insert(hashes)
+	}
+
+	if err == nil && len(hashes) > 0 {
+		err = db.log(walEntry{Op: walInsert, Hashes: hashes})
+	}
+	return err
+}
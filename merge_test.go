@@ -0,0 +1,244 @@
+package disgo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRadixIndexMerge(t *testing.T) {
+	hashes := benchmarkHashes(2000)
+	tests := []struct {
+		index []PHash
+		other []PHash
+	}{
+		{nil, nil},
+		{nil, []PHash{0x42}},
+		{[]PHash{0x42}, nil},
+		{[]PHash{0x42}, []PHash{0x42, 0x42}},
+		{[]PHash{0x42}, []PHash{0x43}},
+		{[]PHash{0x42, 0x43}, []PHash{0x8000000000000042}},
+		{[]PHash{0x8000000000000042}, []PHash{0x42, 0x43}},
+		{[]PHash{0x40, 0x41}, []PHash{0x42, 0x43}},
+		{[]PHash{0x42, 0x43}, []PHash{0x42, 0x43, 0x4000}},
+		{hashes[:1000], hashes[1000:]},
+		{hashes[500:1500], hashes},
+		{hashes, hashes[:10]},
+	}
+
+	for i, test := range tests {
+		expected := BuildRadixIndex(append(append([]PHash(nil), test.index...), test.other...))
+		index := BuildRadixIndex(test.index)
+		other := BuildRadixIndex(test.other)
+		if err := index.Merge(other); err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+		}
+
+		if !expected.root.(*Node).Equal(index.root.(*Node)) {
+			t.Errorf("tests[%d] expected merge to match inserting both", i)
+		}
+
+		if !BuildRadixIndex(test.other).root.(*Node).Equal(other.root.(*Node)) {
+			t.Errorf("tests[%d] expected other to be unchanged", i)
+		}
+
+		// the merged tree must not share nodes with other
+		other.Insert(0xffff)
+		if !expected.root.(*Node).Equal(index.root.(*Node)) {
+			t.Errorf("tests[%d] expected merged index to be independent of other", i)
+		}
+	}
+
+	index := BuildRadixIndex([]PHash{0x01, 0x02})
+	index.Merge(index)
+	if expected := BuildRadixIndex([]PHash{0x01, 0x01, 0x02, 0x02}); !expected.root.(*Node).Equal(index.root.(*Node)) {
+		t.Errorf("Expected merging an index with itself to double its counts")
+	}
+
+	// other's IDs refer to its own records, so they aren't merged
+	index = NewRadixIndex()
+	index.InsertID(0x01, 1)
+	other := NewRadixIndex()
+	other.InsertID(0x01, 2)
+	other.InsertID(0x02, 3)
+	index.Merge(other)
+	expected := postings{0x01: {1}}
+	if !reflect.DeepEqual(expected, index.postings) {
+		t.Errorf("Expected %v got %v", expected, index.postings)
+	}
+
+	index = NewRadixIndex()
+	trn := &testRadixNode{}
+	index.root = trn
+	index.Merge(BuildRadixIndex([]PHash{0x42}))
+	if expected := (&Node{length: 64, prefix: PHash(0x42)}); !expected.Equal(trn.insertedNode) {
+		t.Errorf("Expected %v got %v", expected, trn.insertedNode)
+	}
+}
+
+func TestRadixIndexDiff(t *testing.T) {
+	tests := []struct {
+		index     []PHash
+		other     []PHash
+		onlyIndex []PHash
+		onlyOther []PHash
+	}{
+		{nil, nil, nil, nil},
+		{[]PHash{0x01}, nil, []PHash{0x01}, nil},
+		{nil, []PHash{0x01}, nil, []PHash{0x01}},
+		{[]PHash{0x01, 0x01, 0x02}, []PHash{0x01}, []PHash{0x02}, nil},
+		{[]PHash{0x01, 0x03, 0x05}, []PHash{0x02, 0x03, 0x06}, []PHash{0x01, 0x05}, []PHash{0x02, 0x06}},
+	}
+
+	for i, test := range tests {
+		onlyIndex, onlyOther, err := BuildRadixIndex(test.index).Diff(BuildRadixIndex(test.other))
+		if err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+		}
+
+		if !reflect.DeepEqual(test.onlyIndex, onlyIndex) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.onlyIndex, onlyIndex)
+		}
+
+		if !reflect.DeepEqual(test.onlyOther, onlyOther) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.onlyOther, onlyOther)
+		}
+	}
+}
+
+func TestDBMerge(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "a.png"})
+	db.addRecord(ImageInfo{Hash: 0x02, Location: "b.png"})
+	db.Collection("x").AddHash(0x07)
+
+	other := New()
+	other.addRecord(ImageInfo{Hash: 0x03, Location: "b.png"})
+	other.addRecord(ImageInfo{Hash: 0x01, Location: "c.png", Width: 4})
+	other.AddHash(0x01)
+	other.AddHash(0x05)
+	other.Collection("x").AddHash(0x08)
+	other.Collection("y").AddHash(0x09)
+
+	if err := db.Merge(other); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	// b.png keeps its ID and c.png gets a new one
+	expected := map[string]ImageInfo{
+		"a.png": {ID: 1, Hash: 0x01, Location: "a.png"},
+		"b.png": {ID: 2, Hash: 0x03, Location: "b.png"},
+		"c.png": {ID: 3, Hash: 0x01, Location: "c.png", Width: 4},
+	}
+
+	if records := testRecords(db); !reflect.DeepEqual(expected, records) {
+		t.Errorf("Expected %v got %v", expected, records)
+	}
+
+	var matches []Match
+	db.Walk(func(match Match) bool {
+		matches = append(matches, match)
+		return true
+	})
+
+	expectedMatches := []Match{{0x01, 0, 3, []uint64{1, 3}}, {0x03, 0, 1, []uint64{2}}, {0x05, 0, 1, nil}}
+	if !reflect.DeepEqual(expectedMatches, matches) {
+		t.Errorf("Expected %v got %v", expectedMatches, matches)
+	}
+
+	for name, expected := range map[string][]PHash{"x": {0x07, 0x08}, "y": {0x09}} {
+		if hashes, _ := db.Collection(name).SearchByHash(0, 64); !reflect.DeepEqual(expected, hashes) {
+			t.Errorf("Expected %v got %v", expected, hashes)
+		}
+	}
+
+	if records := testRecords(other); len(records) != 2 || records["c.png"].ID != 2 {
+		t.Errorf("Expected other to be unchanged got %v", records)
+	}
+}
+
+func TestDBMergeIndexes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		index func() Index
+		other func() Index
+	}{
+		{newRadixIndex, newRadixIndex},
+		{newRadixIndex, newLinearIndex},
+		{newLinearIndex, newRadixIndex},
+		{newLinearIndex, newLinearIndex},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d.wal", i))
+		db := NewDB(test.index())
+		db.AddHash(0x01)
+		db.OpenWAL(path, WALOptions{})
+
+		other := NewDB(test.other())
+		other.addRecord(ImageInfo{Hash: 0x01, Location: "a.png"})
+		other.AddHash(0x01)
+		other.AddHash(0x02)
+		other.AddHash(0x02)
+		if err := db.Merge(other); err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+		}
+		db.Close()
+
+		// the bare hashes are logged along with the records
+		replayed := NewDB(test.index())
+		replayed.AddHash(0x01)
+		replayed.OpenWAL(path, WALOptions{})
+		for j, merged := range []*DB{db, replayed} {
+			counts := make(map[PHash]int)
+			for _, match := range testWalk(merged) {
+				counts[match.Hash] = match.Count
+			}
+
+			if expected := map[PHash]int{0x01: 3, 0x02: 2}; !reflect.DeepEqual(expected, counts) {
+				t.Errorf("tests[%d][%d] expected %v got %v", i, j, expected, counts)
+			}
+
+			if records := testRecords(merged); len(records) != 1 || records["a.png"].ID != 1 {
+				t.Errorf("tests[%d][%d] expected a.png got %v", i, j, records)
+			}
+		}
+		replayed.Close()
+	}
+}
+
+// benchmarkMergeHashes returns two sets of n hashes from the same clusters
+func benchmarkMergeHashes(n int) (index, other []PHash) {
+	hashes := benchmarkHashes(2 * n)
+	return hashes[:n], hashes[n:]
+}
+
+func BenchmarkRadixIndexMerge10000(b *testing.B) {
+	hashes, otherHashes := benchmarkMergeHashes(10000)
+	other := BuildRadixIndex(otherHashes)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		index := BuildRadixIndex(hashes)
+		b.StartTimer()
+		index.Merge(other)
+	}
+}
+
+// BenchmarkRadixIndexInsertBatch10000 inserts the hashes merged by
+// BenchmarkRadixIndexMerge10000 instead
+func BenchmarkRadixIndexInsertBatch10000(b *testing.B) {
+	hashes, otherHashes := benchmarkMergeHashes(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		index := BuildRadixIndex(hashes)
+		b.StartTimer()
+		index.InsertBatch(otherHashes)
+	}
+}
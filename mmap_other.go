@@ -0,0 +1,17 @@
+//go:build !unix
+
+package disgo
+
+import (
+	"io"
+	"os"
+)
+
+// mmap falls back to reading the whole file on platforms without mmap
+func mmap(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(file, data)
+	return data, err
+}
+
+func munmap([]byte) error { return nil }
@@ -0,0 +1,82 @@
+package disgo
+
+import "sort"
+
+// PostingIndex is implemented by indexes that keep a posting list of image
+// IDs for each hash.  Matches found by their searches have IDs set
+type PostingIndex interface {
+	// InsertID inserts hash as the hash of the image id
+	InsertID(hash PHash, id uint64) error
+
+	// RemoveID removes one occurrence of hash, and id from its posting
+	// list.  It returns ErrNotFound if id is not in the list
+	RemoveID(hash PHash, id uint64) error
+}
+
+// postings maps hashes to the sorted IDs of the images that have them
+type postings map[PHash][]uint64
+
+func (p postings) add(hash PHash, id uint64) {
+	ids := p[hash]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	p[hash] = ids
+}
+
+func (p postings) remove(hash PHash, id uint64) bool {
+	ids := p[hash]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if i == len(ids) || ids[i] != id {
+		return false
+	}
+
+	if len(ids) == 1 {
+		delete(p, hash)
+	} else {
+		p[hash] = append(ids[:i], ids[i+1:]...)
+	}
+	return true
+}
+
+// ids returns a copy of the posting list for hash
+func (p postings) ids(hash PHash) []uint64 {
+	if ids := p[hash]; len(ids) > 0 {
+		return append([]uint64(nil), ids...)
+	}
+	return nil
+}
+
+func (ri *RadixIndex) InsertID(hash PHash, id uint64) error {
+	err := ri.Insert(hash)
+	if err == nil {
+		if ri.postings == nil {
+			ri.postings = make(postings)
+		}
+		ri.postings.add(hash, id)
+	}
+	return err
+}
+
+func (ri *RadixIndex) RemoveID(hash PHash, id uint64) error {
+	if !ri.postings.remove(hash, id) {
+		return ErrNotFound
+	}
+	return ri.Remove(hash)
+}
+
+func (li *LinearIndex) InsertID(hash PHash, id uint64) error {
+	err := li.Insert(hash)
+	if err == nil {
+		li.postings.add(hash, id)
+	}
+	return err
+}
+
+func (li *LinearIndex) RemoveID(hash PHash, id uint64) error {
+	if !li.postings.remove(hash, id) {
+		return ErrNotFound
+	}
+	return li.Remove(hash)
+}
@@ -2,8 +2,11 @@ package disgo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math/bits"
+	"sort"
 )
 
 var bitmasks = []PHash{
@@ -29,9 +32,19 @@ func (flags *nodeFlags) setHasLeft()   { (*flags) |= 0x80 }
 func (flags nodeFlags) HasRight() bool { return flags&0x40 == 0x40 }
 func (flags *nodeFlags) setHasRight()  { (*flags) |= 0x40 }
 
+// HasDuplicates is set on leaves whose hash was inserted more than once.
+// The encoded node is followed by the number of duplicates as a big endian
+// uint32
+func (flags nodeFlags) HasDuplicates() bool { return flags&0x20 == 0x20 }
+func (flags *nodeFlags) setHasDuplicates()  { (*flags) |= 0x20 }
+
 type radixNode interface {
 	Insert(*Node)
-	Search(PHash, PHash, int) []PHash
+	Remove(*Node) bool
+	Pairs(int) []Pair
+	SearchContext(context.Context, PHash, PHash, int) ([]PHash, error)
+	AppendSearch(context.Context, []PHash, PHash, PHash, int) ([]PHash, error)
+	SearchFuncContext(context.Context, PHash, PHash, int, func(Match) bool) error
 	Encode(io.Writer) error
 	Decode(io.Reader) error
 }
@@ -41,6 +54,15 @@ type Node struct {
 	length uint8
 	left   *Node
 	right  *Node
+
+	// duplicates is the number of times a leaf's hash was inserted beyond
+	// the first
+	duplicates uint32
+}
+
+// Count returns the number of times a leaf's hash has been inserted
+func (n *Node) Count() int {
+	return int(n.duplicates) + 1
 }
 
 func (n *Node) IsLeaf() bool {
@@ -60,6 +82,7 @@ func (n *Node) Match(value PHash) (length uint8) {
 
 func (n *Node) Insert(value *Node) {
 	if n.length == value.length && n.prefix == value.prefix {
+		n.duplicates += value.duplicates + 1
 		return
 	}
 
@@ -69,12 +92,14 @@ func (n *Node) Insert(value *Node) {
 
 	if n.length > matchLength {
 		newNode := &Node{
-			prefix: n.prefix << matchLength,
-			length: n.length - matchLength,
-			left:   n.left,
-			right:  n.right,
+			prefix:     n.prefix << matchLength,
+			length:     n.length - matchLength,
+			left:       n.left,
+			right:      n.right,
+			duplicates: n.duplicates,
 		}
 
+		n.duplicates = 0
 		n.length = matchLength
 		n.prefix = n.prefix & bitmasks[matchLength]
 		if value.prefix&bitmasks[1] == 0 {
@@ -108,34 +133,346 @@ func (n *Node) Insert(value *Node) {
 	}
 }
 
+// Remove deletes one occurrence of value from the tree rooted at n.  Any
+// node that is left with a single child is merged with that child so the
+// tree remains compressed.  Remove returns false if value was not found in
+// the tree
+func (n *Node) Remove(value *Node) bool {
+	if n.Match(value.prefix) < n.length {
+		return false
+	}
+
+	if n.IsLeaf() {
+		if n.length != value.length {
+			return false
+		} else if n.duplicates > 0 {
+			n.duplicates--
+		} else {
+			*n = Node{}
+		}
+		return true
+	}
+
+	value.prefix = value.prefix << n.length
+	value.length = value.length - n.length
+
+	child := &n.left
+	if value.prefix&bitmasks[1] != 0 {
+		child = &n.right
+	}
+
+	if *child == nil || !(*child).Remove(value) {
+		return false
+	}
+
+	if (*child).length == 0 {
+		*child = nil
+	}
+
+	// the root node (zero length) is allowed to have a single child,
+	// everything else gets merged with its remaining child
+	if n.length > 0 && (n.left == nil || n.right == nil) {
+		remaining := n.left
+		if remaining == nil {
+			remaining = n.right
+		}
+		n.prefix = n.prefix | remaining.prefix>>n.length
+		n.length = n.length + remaining.length
+		n.left = remaining.left
+		n.right = remaining.right
+		n.duplicates = remaining.duplicates
+	}
+	return true
+}
+
+// nodeSlab allocates the nodes for a batch insert from a single slice
+type nodeSlab []Node
+
+func (slab *nodeSlab) alloc(node Node) *Node {
+	*slab = append(*slab, node)
+	return &(*slab)[len(*slab)-1]
+}
+
+// buildNode builds the compressed subtree holding hashes, which must be
+// sorted and share their first depth bits
+func (slab *nodeSlab) buildNode(hashes []PHash, depth uint8) *Node {
+	first, last := hashes[0]<<depth, hashes[len(hashes)-1]<<depth
+	if first == last {
+		return slab.alloc(Node{prefix: first, length: 64 - depth, duplicates: uint32(len(hashes) - 1)})
+	}
+
+	length := uint8(bits.LeadingZeros64(uint64(first ^ last)))
+	n := slab.alloc(Node{prefix: first & bitmasks[length], length: length})
+	slab.insertChildren(n, hashes, depth+length)
+	return n
+}
+
+// insertSorted adds hashes, which must be sorted and share their first
+// depth bits with the path to n, to the subtree rooted at n
+func (slab *nodeSlab) insertSorted(n *Node, hashes []PHash, depth uint8) {
+	// the hashes between the first and last share at least as much of
+	// n's prefix as the first and last do
+	matchLength := n.Match(hashes[0] << depth)
+	if length := n.Match(hashes[len(hashes)-1] << depth); length < matchLength {
+		matchLength = length
+	}
+
+	if n.length > matchLength {
+		rest := slab.alloc(Node{
+			prefix:     n.prefix << matchLength,
+			length:     n.length - matchLength,
+			left:       n.left,
+			right:      n.right,
+			duplicates: n.duplicates,
+		})
+
+		n.duplicates = 0
+		n.prefix = n.prefix & bitmasks[matchLength]
+		n.length = matchLength
+		n.left, n.right = nil, nil
+		if rest.prefix&bitmasks[1] == 0 {
+			n.left = rest
+		} else {
+			n.right = rest
+		}
+	} else if n.length > 0 && n.IsLeaf() {
+		// every hash in the batch is the leaf's hash
+		n.duplicates += uint32(len(hashes))
+		return
+	}
+	slab.insertChildren(n, hashes, depth+n.length)
+}
+
+// insertChildren divides hashes between n's children at bit depth
+func (slab *nodeSlab) insertChildren(n *Node, hashes []PHash, depth uint8) {
+	bit := PHash(1) << (63 - depth)
+	i := sort.Search(len(hashes), func(i int) bool { return hashes[i]&bit != 0 })
+	slab.insertChild(&n.left, hashes[:i], depth)
+	slab.insertChild(&n.right, hashes[i:], depth)
+}
+
+func (slab *nodeSlab) insertChild(child **Node, hashes []PHash, depth uint8) {
+	if len(hashes) == 0 {
+		return
+	} else if *child == nil {
+		*child = slab.buildNode(hashes, depth)
+	} else {
+		slab.insertSorted(*child, hashes, depth)
+	}
+}
+
 func (n *Node) distance(hash PHash) int {
 	return n.prefix.Distance(hash & bitmasks[n.length])
 }
 
+// cancelCheckInterval is the number of nodes a search visits between checks
+// for a cancelled context
+const cancelCheckInterval = 256
+
+type searchContext struct {
+	ctx         context.Context
+	maxDistance int
+	visited     int
+	err         error
+}
+
+func (sc *searchContext) cancelled() bool {
+	if sc.err == nil {
+		if sc.visited%cancelCheckInterval == 0 {
+			sc.err = sc.ctx.Err()
+		}
+		sc.visited++
+	}
+	return sc.err != nil
+}
+
+// searchFrame is a node waiting to be visited by a radixIterator, along with
+// the search state on the way to it
+type searchFrame struct {
+	node     *Node
+	search   PHash
+	match    PHash
+	distance int
+}
+
+// maxSearchDepth bounds the stack used by a radixIterator: every node below
+// the root consumes at least one bit, and at most one sibling is pending
+// for each level of the tree
+const maxSearchDepth = 66
+
+// radixIterator walks a tree depth first, using an explicit stack rather
+// than recursion, and yields the leaves within the search distance in
+// ascending order.  It doesn't allocate unless the tree is malformed and
+// deeper than maxSearchDepth
+type radixIterator struct {
+	searchContext
+	top      int
+	frames   [maxSearchDepth]searchFrame
+	overflow []searchFrame
+}
+
+func (it *radixIterator) reset(ctx context.Context, root *Node, search, match PHash, distance int) {
+	it.searchContext = searchContext{ctx: ctx, maxDistance: distance}
+	it.top = 0
+	it.overflow = it.overflow[:0]
+	it.push(searchFrame{root, search, match, distance})
+}
+
+func (it *radixIterator) push(frame searchFrame) {
+	if it.top < len(it.frames) {
+		it.frames[it.top] = frame
+		it.top++
+	} else {
+		it.overflow = append(it.overflow, frame)
+	}
+}
+
+func (it *radixIterator) pop() (frame searchFrame, ok bool) {
+	if len(it.overflow) > 0 {
+		frame = it.overflow[len(it.overflow)-1]
+		it.overflow = it.overflow[:len(it.overflow)-1]
+		return frame, true
+	} else if it.top > 0 {
+		it.top--
+		return it.frames[it.top], true
+	}
+	return frame, false
+}
+
+// next returns the next match, or false once the search is complete or the
+// context has been cancelled
+func (it *radixIterator) next() (Match, bool) {
+	for frame, ok := it.pop(); ok; frame, ok = it.pop() {
+		if it.cancelled() {
+			return Match{}, false
+		}
+
+		// add my prefix to the match
+		n := frame.node
+		if n.length > 0 {
+			frame.match = frame.match << n.length
+			frame.match = frame.match | n.prefix>>(64-n.length)
+			frame.distance -= n.distance(frame.search)
+			frame.search = frame.search << n.length
+		}
+
+		if frame.distance < 0 {
+			continue
+		}
+
+		if n.length > 0 && n.IsLeaf() {
+			return Match{Hash: frame.match, Distance: it.maxDistance - frame.distance, Count: n.Count()}, true
+		}
+
+		// push right first so the left subtree is visited first
+		if n.right != nil {
+			it.push(searchFrame{n.right, frame.search, frame.match, frame.distance})
+		}
+
+		if n.left != nil {
+			it.push(searchFrame{n.left, frame.search, frame.match, frame.distance})
+		}
+	}
+	return Match{}, false
+}
+
 func (n *Node) Search(search PHash, match PHash, distance int) []PHash {
-	if n == nil {
-		return nil
+	matches, _ := n.SearchContext(context.Background(), search, match, distance)
+	return matches
+}
+
+// SearchContext is like Search, but gives up and returns the context's error
+// if ctx is cancelled before the search completes
+func (n *Node) SearchContext(ctx context.Context, search PHash, match PHash, distance int) ([]PHash, error) {
+	matches, err := n.AppendSearch(ctx, nil, search, match, distance)
+	if err != nil {
+		return nil, err
 	}
+	return matches, nil
+}
 
-	// add my prefix to the match
-	if n.length > 0 {
-		match = match << n.length
-		match = match | n.prefix>>(64-n.length)
-		distance -= n.distance(search)
-		search = search << n.length
+// AppendSearch appends each hash within distance of search to dst, in
+// ascending order, and returns the extended slice.  It does not allocate
+// if dst has enough capacity for the results
+func (n *Node) AppendSearch(ctx context.Context, dst []PHash, search PHash, match PHash, distance int) ([]PHash, error) {
+	var it radixIterator
+	it.reset(ctx, n, search, match, distance)
+	for m, ok := it.next(); ok; m, ok = it.next() {
+		dst = append(dst, m.Hash)
 	}
+	return dst, it.err
+}
 
-	if distance < 0 {
+// SearchFuncContext calls fn for each hash within distance of search, in
+// ascending order, until fn returns false or ctx is cancelled
+func (n *Node) SearchFuncContext(ctx context.Context, search PHash, match PHash, distance int, fn func(Match) bool) error {
+	var it radixIterator
+	it.reset(ctx, n, search, match, distance)
+	for m, ok := it.next(); ok && fn(m); m, ok = it.next() {
+	}
+	return it.err
+}
+
+// Pairs finds every pair of distinct hashes in the tree rooted at n that are
+// within maxDistance of each other
+func (n *Node) Pairs(maxDistance int) []Pair {
+	if n.IsLeaf() && n.length == 0 {
 		return nil
 	}
+	return join(n, n, 0, 0, 0, 0, 0, maxDistance, true, nil)
+}
 
-	if n.length > 0 && n.IsLeaf() {
-		return []PHash{match}
+// join walks the subtrees at a and b together, collecting the pairs of
+// leaves (one from each side) that are within maxDistance.  Both sides must
+// be at the same depth: aOffset and bOffset are the number of bits of each
+// node's prefix that have already been consumed and aValue and bValue hold
+// the bits seen on the way down.  When self is true a and b are the same
+// subtree, so only one ordering of each pair is reported
+func join(a, b *Node, aOffset, bOffset uint8, aValue, bValue PHash, distance, maxDistance int, self bool, pairs []Pair) []Pair {
+	length := a.length - aOffset
+	if b.length-bOffset < length {
+		length = b.length - bOffset
 	}
 
-	matches := n.left.Search(search, match, distance)
-	matches = append(matches, n.right.Search(search, match, distance)...)
-	return matches
+	if length > 0 {
+		aBits := (a.prefix << aOffset) & bitmasks[length]
+		bBits := (b.prefix << bOffset) & bitmasks[length]
+		distance += aBits.Distance(bBits)
+		if distance > maxDistance {
+			return pairs
+		}
+		aValue = aValue<<length | aBits>>(64-length)
+		bValue = bValue<<length | bBits>>(64-length)
+		aOffset += length
+		bOffset += length
+	}
+
+	if a.IsLeaf() && b.IsLeaf() {
+		if !self {
+			pairs = append(pairs, Pair{Hash1: aValue, Hash2: bValue, Distance: distance})
+		}
+		return pairs
+	}
+
+	aChildren := []*Node{a}
+	if aOffset == a.length {
+		aChildren, aOffset = []*Node{a.left, a.right}, 0
+	}
+
+	bChildren := []*Node{b}
+	if bOffset == b.length {
+		bChildren, bOffset = []*Node{b.left, b.right}, 0
+	}
+
+	for i, aChild := range aChildren {
+		for j, bChild := range bChildren {
+			if aChild == nil || bChild == nil || (self && j < i) {
+				continue
+			}
+			pairs = join(aChild, bChild, aOffset, bOffset, aValue, bValue, distance, maxDistance, self && i == j, pairs)
+		}
+	}
+	return pairs
 }
 
 func (n *Node) Encode(writer io.Writer) error {
@@ -153,6 +490,11 @@ func (n *Node) Encode(writer io.Writer) error {
 		flags.setHasRight()
 	}
 
+	if n.duplicates > 0 {
+		flags.setHasDuplicates()
+		buf = append(buf, byte(n.duplicates>>24), byte(n.duplicates>>16), byte(n.duplicates>>8), byte(n.duplicates))
+	}
+
 	buf[0] = byte(flags)
 	buf[1] = byte(n.length)
 	buf[2] = byte(n.prefix >> 56)
@@ -177,7 +519,7 @@ func (n *Node) Encode(writer io.Writer) error {
 
 func (n *Node) Decode(reader io.Reader) error {
 	buf := make([]byte, 10)
-	_, err := reader.Read(buf)
+	_, err := io.ReadFull(reader, buf)
 	if err == nil {
 		n.left = nil
 		n.right = nil
@@ -193,19 +535,54 @@ func (n *Node) Decode(reader io.Reader) error {
 		n.prefix |= PHash(buf[8]) << 8
 		n.prefix |= PHash(buf[9])
 
-		if flags.HasLeft() {
+		n.duplicates = 0
+		if flags.HasDuplicates() {
+			_, err = io.ReadFull(reader, buf[:4])
+			n.duplicates = uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+		}
+
+		if err == nil && flags.HasLeft() {
 			n.left = &Node{}
-			n.left.Decode(reader)
+			err = n.left.Decode(reader)
 		}
 
-		if flags.HasRight() {
+		if err == nil && flags.HasRight() {
 			n.right = &Node{}
-			n.right.Decode(reader)
+			err = n.right.Decode(reader)
 		}
 	}
 	return err
 }
 
+// validate checks that the subtree at n, which starts depth bits into the
+// hash, is laid out the way Insert lays out a tree, so that searches can't
+// index past the end of bitmasks.  It returns ErrCorrupt if it isn't
+func (n *Node) validate(depth int, root bool) error {
+	leaf := n.left == nil && n.right == nil
+	depth += int(n.length)
+	switch {
+	case depth > 64:
+		return ErrCorrupt
+	case !root && n.length == 0:
+		return ErrCorrupt
+	case leaf && depth < 64 && (!root || n.length > 0):
+		// only an empty root is a leaf before the last bit
+		return ErrCorrupt
+	case !leaf && (depth == 64 || n.duplicates > 0):
+		return ErrCorrupt
+	}
+
+	var err error
+	if n.left != nil {
+		err = n.left.validate(depth, false)
+	}
+
+	if err == nil && n.right != nil {
+		err = n.right.validate(depth, false)
+	}
+	return err
+}
+
 func (n *Node) Equal(other *Node) bool {
 	if n == other {
 		return true
@@ -213,7 +590,7 @@ func (n *Node) Equal(other *Node) bool {
 		return false
 	}
 
-	if n.prefix == other.prefix && n.length == other.length {
+	if n.prefix == other.prefix && n.length == other.length && n.duplicates == other.duplicates {
 		return n.left.Equal(other.left) && n.right.Equal(other.right)
 	}
 	return false
@@ -224,7 +601,8 @@ func (n *Node) String() string {
 }
 
 type RadixIndex struct {
-	root radixNode
+	root     radixNode
+	postings postings
 }
 
 func NewRadixIndex() *RadixIndex {
@@ -242,8 +620,120 @@ func (ri *RadixIndex) Insert(hash PHash) error {
 	return nil
 }
 
+// radixSortMin is the smallest batch that is radix sorted; smaller ones
+// are quicker to sort by comparison
+const radixSortMin = 256
+
+// radixSort sorts hashes in ascending order a byte at a time, least
+// significant first.  That is linear in the number of hashes, and for
+// large batches several times faster than a comparison sort
+func radixSort(hashes []PHash) {
+	src, dst := hashes, make([]PHash, len(hashes))
+	for shift := uint(0); shift < 64; shift += 8 {
+		var offsets [257]int
+		for _, hash := range src {
+			offsets[hash>>shift&0xff+1]++
+		}
+
+		for i := 1; i < len(offsets); i++ {
+			offsets[i] += offsets[i-1]
+		}
+
+		for _, hash := range src {
+			digit := hash >> shift & 0xff
+			dst[offsets[digit]] = hash
+			offsets[digit]++
+		}
+		src, dst = dst, src
+	}
+}
+
+// InsertBatch inserts all of the hashes, as if by calling Insert for each
+// of them.  They are radix sorted and added in a single pass over the
+// tree, splitting each node at most once and allocating the new nodes
+// together.  For 10,000 hashes that takes a little over half the time of
+// inserting them one at a time (see BenchmarkBuildRadixIndex10000), and a
+// handful of allocations instead of two per hash
+func (ri *RadixIndex) InsertBatch(hashes []PHash) error {
+	root, ok := ri.root.(*Node)
+	if !ok {
+		for _, hash := range hashes {
+			ri.Insert(hash)
+		}
+		return nil
+	}
+
+	if len(hashes) > 0 {
+		sorted := append([]PHash(nil), hashes...)
+		if len(sorted) < radixSortMin {
+			sortHashes(sorted)
+		} else {
+			radixSort(sorted)
+		}
+
+		// every hash adds at most a leaf and the node it splits from
+		slab := make(nodeSlab, 0, 2*len(sorted))
+		slab.insertSorted(root, sorted, 0)
+	}
+	return nil
+}
+
+// BuildRadixIndex returns a RadixIndex holding hashes, built in one pass
+func BuildRadixIndex(hashes []PHash) *RadixIndex {
+	ri := NewRadixIndex()
+	ri.InsertBatch(hashes)
+	return ri
+}
+
+func (ri *RadixIndex) Remove(hash PHash) error {
+	node := &Node{
+		prefix: hash,
+		length: 64,
+	}
+	if ri.root.Remove(node) {
+		return nil
+	}
+	return ErrNotFound
+}
+
 func (ri *RadixIndex) Search(hash PHash, distance int) ([]PHash, error) {
-	return ri.root.Search(hash, 0x00, distance), nil
+	return ri.SearchContext(context.Background(), hash, distance)
+}
+
+func (ri *RadixIndex) SearchContext(ctx context.Context, hash PHash, distance int) ([]PHash, error) {
+	return ri.root.SearchContext(ctx, hash, 0x00, distance)
+}
+
+// AppendSearch appends each hash within distance of hash to dst and returns
+// the extended slice.  Searches that reuse a buffer with enough capacity
+// for their results do not allocate
+func (ri *RadixIndex) AppendSearch(dst []PHash, hash PHash, distance int) ([]PHash, error) {
+	return ri.AppendSearchContext(context.Background(), dst, hash, distance)
+}
+
+func (ri *RadixIndex) AppendSearchContext(ctx context.Context, dst []PHash, hash PHash, distance int) ([]PHash, error) {
+	return ri.root.AppendSearch(ctx, dst, hash, 0x00, distance)
+}
+
+// SearchFunc calls fn for each hash within distance of hash, in ascending
+// order, until fn returns false
+func (ri *RadixIndex) SearchFunc(hash PHash, distance int, fn func(Match) bool) error {
+	return ri.SearchFuncContext(context.Background(), hash, distance, fn)
+}
+
+func (ri *RadixIndex) SearchFuncContext(ctx context.Context, hash PHash, distance int, fn func(Match) bool) error {
+	if len(ri.postings) == 0 {
+		return ri.root.SearchFuncContext(ctx, hash, 0x00, distance, fn)
+	}
+
+	return ri.root.SearchFuncContext(ctx, hash, 0x00, distance, func(match Match) bool {
+		match.IDs = ri.postings.ids(match.Hash)
+		return fn(match)
+	})
+}
+
+func (ri *RadixIndex) Pairs(maxDistance int) ([]Pair, error) {
+	return ri.root.Pairs(maxDistance), nil
 }
 
 func (ri *RadixIndex) MarshalBinary() ([]byte, error) {
@@ -252,7 +742,28 @@ func (ri *RadixIndex) MarshalBinary() ([]byte, error) {
 	return writer.Bytes(), err
 }
 
+// UnmarshalBinary replaces the index with buf.  Posting lists are not part
+// of the encoding, so the index is left without any.  It returns
+// ErrCorrupt, and leaves the index empty, if buf isn't a valid tree
 func (ri *RadixIndex) UnmarshalBinary(buf []byte) error {
+	ri.postings = nil
 	reader := bytes.NewReader(buf)
-	return ri.root.Decode(reader)
+	err := ri.root.Decode(reader)
+	root, ok := ri.root.(*Node)
+	if !ok {
+		return err
+	}
+
+	if err == nil && reader.Len() > 0 {
+		err = ErrCorrupt
+	} else if err == nil {
+		err = root.validate(0, true)
+	} else {
+		err = ErrCorrupt
+	}
+
+	if err != nil {
+		*root = Node{}
+	}
+	return err
 }
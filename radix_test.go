@@ -2,9 +2,12 @@ package disgo
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -98,6 +101,96 @@ func TestNodeInsert(t *testing.T) {
 	}
 }
 
+func TestNodeRemove(t *testing.T) {
+	tests := []struct {
+		prefixes []uint64
+		remove   uint64
+		expected []uint64
+		found    bool
+	}{
+		{nil, 0xff, nil, false},
+		{[]uint64{0xff}, 0xfe, []uint64{0xff}, false},
+		{[]uint64{0xff}, 0xff, nil, true},
+		{[]uint64{0xff, 0xfe}, 0xfe, []uint64{0xff}, true},
+		{[]uint64{0xff, 0xff}, 0xff, []uint64{0xff}, true},
+		{[]uint64{0xff, 0xfe, 0xfe}, 0xff, []uint64{0xfe, 0xfe}, true},
+		{[]uint64{0xfff << 52, 0xff7 << 52, 0x7f << 56}, 0xff7 << 52, []uint64{0xfff << 52, 0x7f << 56}, true},
+		{[]uint64{0xfff << 52, 0xff7 << 52, 0xff3 << 52}, 0xfff << 52, []uint64{0xff7 << 52, 0xff3 << 52}, true},
+	}
+
+	for i, test := range tests {
+		root := &Node{}
+		for _, prefix := range test.prefixes {
+			root.Insert(&Node{length: 64, prefix: PHash(prefix)})
+		}
+
+		expected := &Node{}
+		for _, prefix := range test.expected {
+			expected.Insert(&Node{length: 64, prefix: PHash(prefix)})
+		}
+
+		found := root.Remove(&Node{length: 64, prefix: PHash(test.remove)})
+		if found != test.found {
+			t.Errorf("tests[%d] expected %v got %v", i, test.found, found)
+		}
+
+		if !expected.Equal(root) {
+			t.Errorf("tests[%d] expected %v got %v", i, expected, root)
+		}
+	}
+}
+
+func TestRadixIndexCount(t *testing.T) {
+	tests := []struct {
+		inserts  []PHash
+		removes  []PHash
+		expected []Match
+	}{
+		{[]PHash{0x42}, nil, []Match{{0x42, 0, 1, nil}}},
+		{[]PHash{0x42, 0x42, 0x43}, nil, []Match{{0x42, 0, 2, nil}, {0x43, 1, 1, nil}}},
+		{[]PHash{0x42, 0x42, 0x43}, []PHash{0x42}, []Match{{0x42, 0, 1, nil}, {0x43, 1, 1, nil}}},
+		{[]PHash{0x42, 0x43, 0x43, 0x43}, []PHash{0x42, 0x43}, []Match{{0x43, 1, 2, nil}}},
+		{[]PHash{0x42, 0x42}, []PHash{0x42, 0x42}, nil},
+	}
+
+	for i, test := range tests {
+		for _, index := range []Index{NewRadixIndex(), NewLinearIndex()} {
+			for _, hash := range test.inserts {
+				index.Insert(hash)
+			}
+
+			for _, hash := range test.removes {
+				if err := index.Remove(hash); err != nil {
+					t.Errorf("tests[%d] expected nil got %v", i, err)
+				}
+			}
+
+			var matches []Match
+			index.SearchFunc(0x42, 64, func(match Match) bool {
+				matches = append(matches, match)
+				return true
+			})
+
+			sort.Slice(matches, func(i, j int) bool { return matches[i].Hash < matches[j].Hash })
+			if !reflect.DeepEqual(test.expected, matches) {
+				t.Errorf("tests[%d] %T expected %v got %v", i, index, test.expected, matches)
+			}
+
+			if radix, ok := index.(*RadixIndex); ok {
+				var compact []Match
+				radix.Compact().SearchFunc(0x42, 64, func(match Match) bool {
+					compact = append(compact, match)
+					return true
+				})
+
+				if !reflect.DeepEqual(matches, compact) {
+					t.Errorf("tests[%d] expected %v got %v", i, matches, compact)
+				}
+			}
+		}
+	}
+}
+
 func TestNodeSearch(t *testing.T) {
 	tests := []struct {
 		prefixes        []uint64
@@ -124,6 +217,108 @@ func TestNodeSearch(t *testing.T) {
 	}
 }
 
+func TestNodePairs(t *testing.T) {
+	tests := []struct {
+		prefixes []uint64
+		distance int
+		expected []Pair
+	}{
+		{nil, 64, nil},
+		{[]uint64{0xff}, 64, nil},
+		{[]uint64{0xff, 0xfe}, 0, nil},
+		{[]uint64{0xff, 0xfe}, 1, []Pair{{0xfe, 0xff, 1}}},
+		{[]uint64{0xff, 0xfe, 0xfc, 0xff << 56}, 2, []Pair{{0xfc, 0xfe, 1}, {0xfc, 0xff, 2}, {0xfe, 0xff, 1}}},
+	}
+
+	for i, test := range tests {
+		root := &Node{}
+		for _, prefix := range test.prefixes {
+			root.Insert(&Node{length: 64, prefix: PHash(prefix)})
+		}
+
+		pairs := root.Pairs(test.distance)
+		sortPairs(pairs)
+		if !reflect.DeepEqual(test.expected, pairs) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, pairs)
+		}
+	}
+}
+
+func TestNodePairsRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	root := &Node{}
+	linear := NewLinearIndex()
+	for i := 0; i < 500; i++ {
+		// flip a few bits of a handful of base hashes so there are plenty
+		// of near matches
+		hash := PHash(rng.Int63n(8)) << 40
+		for j := 0; j < 3; j++ {
+			hash ^= 1 << uint(rng.Intn(64))
+		}
+		root.Insert(&Node{length: 64, prefix: hash})
+		linear.Insert(hash)
+	}
+
+	for _, distance := range []int{0, 1, 3, 6} {
+		expected, _ := linear.Pairs(distance)
+		pairs := root.Pairs(distance)
+		sortPairs(expected)
+		sortPairs(pairs)
+		if !reflect.DeepEqual(expected, pairs) {
+			t.Errorf("distance %d expected %d pairs got %d", distance, len(expected), len(pairs))
+		}
+	}
+}
+
+func sortPairs(pairs []Pair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Hash1 == pairs[j].Hash1 {
+			return pairs[i].Hash2 < pairs[j].Hash2
+		}
+		return pairs[i].Hash1 < pairs[j].Hash1
+	})
+}
+
+func TestNodeSearchContext(t *testing.T) {
+	root := &Node{}
+	for i := 0; i < 4*cancelCheckInterval; i++ {
+		root.Insert(&Node{length: 64, prefix: PHash(i)})
+	}
+
+	matches, err := root.SearchContext(context.Background(), 0, 0, 64)
+	if err != nil || len(matches) != 4*cancelCheckInterval {
+		t.Errorf("Expected %d matches got %d (%v)", 4*cancelCheckInterval, len(matches), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	matches, err = root.SearchContext(ctx, 0, 0, 64)
+	if err != context.Canceled || matches != nil {
+		t.Errorf("Expected %v got %v (%d matches)", context.Canceled, err, len(matches))
+	}
+}
+
+func TestRadixIndexAppendSearch(t *testing.T) {
+	index := NewRadixIndex()
+	for i := 0; i < 100; i++ {
+		index.Insert(PHash(i))
+	}
+
+	buf, _ := index.AppendSearch([]PHash{0x42}, 0, 2)
+	expected := []PHash{0x42, 0, 1, 2, 3, 4, 5, 6, 8, 9, 10, 12, 16, 17, 18, 20, 24, 32, 33, 34, 36, 40, 48, 64, 65, 66, 68, 72, 80, 96}
+	if !reflect.DeepEqual(expected, buf) {
+		t.Errorf("Expected %v got %v", expected, buf)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = index.AppendSearch(buf[:0], 0x37, 3)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected no allocations got %v", allocs)
+	}
+}
+
 func TestNodeEncode(t *testing.T) {
 	tests := []struct {
 		prefixes []uint64
@@ -131,6 +326,7 @@ func TestNodeEncode(t *testing.T) {
 	}{
 		{[]uint64{0xff}, []byte{0x00, 0x40, 0, 0, 0, 0, 0, 0, 0, 0xff}},
 		{[]uint64{0xfff << 52, 0xff7 << 52}, []byte{0xc0, 0x08, 0xff, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x38, 0x70, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x38, 0xf0, 0, 0, 0, 0, 0, 0, 0}},
+		{[]uint64{0xff, 0xff, 0xff}, []byte{0x20, 0x40, 0, 0, 0, 0, 0, 0, 0, 0xff, 0, 0, 0, 0x02}},
 	}
 
 	for i, test := range tests {
@@ -193,6 +389,7 @@ func TestNodeDecode(t *testing.T) {
 	}{
 		{[]byte{0x00, 0x40, 0, 0, 0, 0, 0, 0, 0, 0xff}, []uint64{0xff}},
 		{[]byte{0xc0, 0x08, 0xff, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x38, 0x70, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x38, 0xf0, 0, 0, 0, 0, 0, 0, 0}, []uint64{0xfff << 52, 0xff7 << 52}},
+		{[]byte{0x20, 0x40, 0, 0, 0, 0, 0, 0, 0, 0xff, 0, 0, 0, 0x02}, []uint64{0xff, 0xff, 0xff}},
 	}
 
 	for i, test := range tests {
@@ -214,21 +411,49 @@ func TestNodeDecode(t *testing.T) {
 
 type testRadixNode struct {
 	insertedNode   *Node
+	removedNode    *Node
+	removeResult   bool
 	search         PHash
 	searchMatch    PHash
 	searchDistance int
 	searchResults  []PHash
+	pairs          []Pair
 	encodeBuf      []byte
 	decodeBuf      []byte
 }
 
 func (trn *testRadixNode) Insert(node *Node) { trn.insertedNode = node }
 
-func (trn *testRadixNode) Search(search, match PHash, distance int) []PHash {
+func (trn *testRadixNode) Remove(node *Node) bool {
+	trn.removedNode = node
+	return trn.removeResult
+}
+
+func (trn *testRadixNode) Pairs(distance int) []Pair {
+	trn.searchDistance = distance
+	return trn.pairs
+}
+
+func (trn *testRadixNode) SearchContext(ctx context.Context, search, match PHash, distance int) ([]PHash, error) {
 	trn.search = search
 	trn.searchMatch = match
 	trn.searchDistance = distance
-	return trn.searchResults
+	return trn.searchResults, nil
+}
+
+func (trn *testRadixNode) AppendSearch(ctx context.Context, dst []PHash, search, match PHash, distance int) ([]PHash, error) {
+	results, err := trn.SearchContext(ctx, search, match, distance)
+	return append(dst, results...), err
+}
+
+func (trn *testRadixNode) SearchFuncContext(ctx context.Context, search, match PHash, distance int, fn func(Match) bool) error {
+	results, err := trn.SearchContext(ctx, search, match, distance)
+	for _, result := range results {
+		if !fn(Match{Hash: result}) {
+			break
+		}
+	}
+	return err
 }
 
 func (trn *testRadixNode) Encode(writer io.Writer) error {
@@ -252,6 +477,88 @@ func TestRadixIndexInsert(t *testing.T) {
 	}
 }
 
+func TestRadixIndexInsertBatch(t *testing.T) {
+	hashes := benchmarkHashes(2000)
+	tests := []struct {
+		existing []PHash
+		batch    []PHash
+	}{
+		{nil, nil},
+		{nil, []PHash{0x42}},
+		{nil, []PHash{0x42, 0x42, 0x43}},
+		{[]PHash{0x42}, []PHash{0x42}},
+		{[]PHash{0x42}, []PHash{0x8000000000000042, 0x43}},
+		{nil, hashes},
+		{hashes[:1000], hashes[1000:]},
+		{hashes[500:1500], hashes},
+		{hashes, hashes[:10]},
+	}
+
+	for i, test := range tests {
+		expected := NewRadixIndex()
+		index := NewRadixIndex()
+		for _, hash := range test.existing {
+			expected.Insert(hash)
+			index.Insert(hash)
+		}
+
+		for _, hash := range test.batch {
+			expected.Insert(hash)
+		}
+
+		index.InsertBatch(test.batch)
+		if !expected.root.(*Node).Equal(index.root.(*Node)) {
+			t.Errorf("tests[%d] expected batch insert to match individual inserts", i)
+		}
+	}
+
+	built := BuildRadixIndex(hashes)
+	if !built.root.(*Node).Equal(newTestRadixIndex(2000).root.(*Node)) {
+		t.Errorf("Expected built index to match individual inserts")
+	}
+
+	index := NewRadixIndex()
+	trn := &testRadixNode{}
+	index.root = trn
+	index.InsertBatch([]PHash{0x42})
+	expected := &Node{length: 64, prefix: PHash(0x42)}
+	if !expected.Equal(trn.insertedNode) {
+		t.Errorf("Expected %v got %v", expected, trn.insertedNode)
+	}
+}
+
+func TestRadixSort(t *testing.T) {
+	for i, hashes := range [][]PHash{nil, {0x42}, benchmarkHashes(1000), append(benchmarkHashes(300), benchmarkHashes(300)...)} {
+		expected := append([]PHash(nil), hashes...)
+		sortHashes(expected)
+		radixSort(hashes)
+		if !reflect.DeepEqual(expected, hashes) {
+			t.Errorf("tests[%d] expected hashes to be sorted got %v", i, hashes)
+		}
+	}
+}
+
+func TestRadixIndexRemove(t *testing.T) {
+	index := NewRadixIndex()
+	trn := &testRadixNode{}
+	index.root = trn
+	err := index.Remove(PHash(0x42))
+	if err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	expected := &Node{length: 64, prefix: PHash(0x42)}
+	if !expected.Equal(trn.removedNode) {
+		t.Errorf("Expected %v got %v", expected, trn.removedNode)
+	}
+
+	trn.removeResult = true
+	err = index.Remove(PHash(0x42))
+	if err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+}
+
 func TestRadixIndexSearch(t *testing.T) {
 	index := NewRadixIndex()
 	trn := &testRadixNode{}
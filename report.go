@@ -0,0 +1,170 @@
+package disgo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"image/jpeg"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// ThumbnailSize is the largest width or height of the thumbnails embedded
+// in HTML reports
+var ThumbnailSize = 160
+
+// SearchGroup searches for images within maxDistance of query and returns
+// them as a group, with the query as the first image, so that search
+// results can be written with the same reports as duplicate groups
+func (db *DB) SearchGroup(query ImageInfo, maxDistance int) (DuplicateGroup, error) {
+	group := DuplicateGroup{Images: []ImageInfo{query}}
+	matches, err := db.SearchByHash(query.Hash, maxDistance)
+	if err != nil {
+		return group, err
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	for _, match := range matches {
+		if match != query.Hash {
+			group.Pairs = append(group.Pairs, Pair{Hash1: query.Hash, Hash2: match, Distance: query.Hash.Distance(match)})
+		}
+
+		infos, err := db.records.Hash(match)
+		if err != nil {
+			return group, err
+		}
+
+		if len(infos) > 0 {
+			for _, info := range infos {
+				if info.Location != query.Location {
+					group.Images = append(group.Images, info)
+				}
+			}
+		} else if match != query.Hash || query.Location != "" {
+			group.Images = append(group.Images, ImageInfo{Hash: match})
+		}
+	}
+	return group, nil
+}
+
+// WriteJSONReport writes the groups to writer as a JSON array
+func WriteJSONReport(writer io.Writer, groups []DuplicateGroup) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(groups)
+}
+
+// WriteCSVReport writes one row per image in each group.  The distance
+// column is the distance from the first image in the group, and hashes
+// are written in their 16 digit text form (see PHash.MarshalText)
+func WriteCSVReport(writer io.Writer, groups []DuplicateGroup) error {
+	w := csv.NewWriter(writer)
+	w.Write([]string{"group", "distance", "hash", "location", "size", "width", "height", "mtime", "checksum"})
+	for i, group := range groups {
+		for _, info := range group.Images {
+			mtime := ""
+			if !info.ModTime.IsZero() {
+				mtime = info.ModTime.Format(time.RFC3339)
+			}
+			hash, _ := info.Hash.MarshalText()
+
+			w.Write([]string{
+				strconv.Itoa(i + 1),
+				strconv.Itoa(group.Images[0].Hash.Distance(info.Hash)),
+				string(hash),
+				info.Location,
+				strconv.FormatInt(info.Size, 10),
+				strconv.Itoa(info.Width),
+				strconv.Itoa(info.Height),
+				mtime,
+				info.Checksum,
+			})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+type reportImage struct {
+	ImageInfo
+	Distance  int
+	Thumbnail template.URL
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"inc":  func(i int) int { return i + 1 },
+	"hash": func(h PHash) uint64 { return uint64(h) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Duplicate images</title>
+<style>
+body { font-family: sans-serif; }
+.group { padding-bottom: 1em; display: flex; flex-wrap: wrap; }
+.image { margin-right: 1em; width: {{.Size}}px; font-size: small; word-wrap: break-word; }
+.missing { width: {{.Size}}px; height: {{.Size}}px; background: #eee; }
+</style>
+</head>
+<body>
+<h1>Duplicate images</h1>
+{{range $i, $group := .Groups}}<h2>Group {{inc $i}}</h2>
+<div class="group">
+{{range $group}}<div class="image">
+{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.Location}}">{{else}}<div class="missing"></div>{{end}}
+<div>{{.Location}}</div>
+<div>{{printf "%016x" (hash .Hash)}} distance {{.Distance}}</div>
+<div>{{.Width}}x{{.Height}}, {{.Size}} bytes</div>
+</div>
+{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+func thumbnail(location string) template.URL {
+	if location == "" {
+		return ""
+	}
+
+	img, err := imaging.Open(location)
+	if err != nil {
+		return ""
+	}
+
+	buf := bytes.NewBuffer(nil)
+	img = imaging.Fit(img, ThumbnailSize, ThumbnailSize, imaging.Box)
+	if jpeg.Encode(buf, img, nil) != nil {
+		return ""
+	}
+	return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+// WriteHTMLReport writes a standalone HTML page showing each group's images
+// side by side.  Thumbnails are embedded in the page so it can be viewed
+// without access to the original files
+func WriteHTMLReport(writer io.Writer, groups []DuplicateGroup) error {
+	var data struct {
+		Size   int
+		Groups [][]reportImage
+	}
+
+	data.Size = ThumbnailSize
+	for _, group := range groups {
+		var images []reportImage
+		for _, info := range group.Images {
+			images = append(images, reportImage{
+				ImageInfo: info,
+				Distance:  group.Images[0].Hash.Distance(info.Hash),
+				Thumbnail: thumbnail(info.Location),
+			})
+		}
+		data.Groups = append(data.Groups, images)
+	}
+	return reportTemplate.Execute(writer, data)
+}
@@ -0,0 +1,109 @@
+package disgo
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDBSearchGroup(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x00, Location: "a.png"})
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "b.png"})
+	db.AddHash(0x03)
+	db.AddHash(0xff)
+
+	group, err := db.SearchGroup(ImageInfo{Hash: 0x00, Location: "a.png"}, 2)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	var locations []string
+	for _, info := range group.Images {
+		locations = append(locations, info.Location)
+	}
+
+	if len(locations) != 3 || locations[0] != "a.png" {
+		t.Errorf("Expected query followed by b.png and an unrecorded hash got %v", locations)
+	}
+
+	if len(group.Pairs) != 2 {
+		t.Errorf("Expected 2 pairs got %v", group.Pairs)
+	}
+}
+
+func testGroups(t *testing.T) (string, []DuplicateGroup) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	writeTestImage(t, filepath.Join(dir, "a.png"), 0x81)
+	return dir, []DuplicateGroup{
+		{
+			Images: []ImageInfo{
+				{Hash: 0x00, Location: filepath.Join(dir, "a.png"), Width: 9, Height: 8},
+				{Hash: 0x03, Location: "<missing>.png"},
+			},
+			Pairs: []Pair{{0x00, 0x03, 2}},
+		},
+	}
+}
+
+func TestWriteJSONReport(t *testing.T) {
+	dir, groups := testGroups(t)
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBuffer(nil)
+	if err := WriteJSONReport(buf, groups); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	var decoded []DuplicateGroup
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if !reflect.DeepEqual(groups, decoded) {
+		t.Errorf("Expected %v got %v", groups, decoded)
+	}
+}
+
+func TestWriteCSVReport(t *testing.T) {
+	dir, groups := testGroups(t)
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBuffer(nil)
+	if err := WriteCSVReport(buf, groups); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	rows, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	expected := []string{"1", "2", "0000000000000003", "<missing>.png", "0", "0", "0", "", ""}
+	if len(rows) != 3 || !reflect.DeepEqual(expected, rows[2]) {
+		t.Errorf("Expected %v got %v", expected, rows)
+	}
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	dir, groups := testGroups(t)
+	defer os.RemoveAll(dir)
+
+	buf := bytes.NewBuffer(nil)
+	if err := WriteHTMLReport(buf, groups); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	html := buf.String()
+	for _, expected := range []string{"data:image/jpeg;base64,", "&lt;missing&gt;.png", `class="missing"`, "distance 2"} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("Expected report to contain %q", expected)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package disgo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SaveFile saves the database to path.  The snapshot is written to a
+// temporary file and synced to disk before it is renamed over path, so a
+// crash leaves either the old or the new snapshot in place.  If backups is
+// greater than zero the previous snapshots are kept as path.1 (the most
+// recent) through path.N
+func (db *DB) SaveFile(path string, backups int) error {
+	buf, err := db.MarshalBinary()
+	if err == nil {
+		err = writeFile(path, buf, backups)
+	}
+	return err
+}
+
+// LoadFile loads the snapshot at path.  If it is missing or corrupt, the
+// backups kept by SaveFile are tried in turn, most recent first.  If none
+// of them can be loaded the error for path is returned.  Only snapshots
+// written by SaveFile are loaded; anything else, including a bare index,
+// is corrupt
+func (db *DB) LoadFile(path string) error {
+	err := loadFile(db, path)
+	if err == nil {
+		return nil
+	}
+
+	for i := 1; ; i++ {
+		backupErr := loadFile(db, backupName(path, i))
+		if backupErr == nil {
+			return nil
+		} else if os.IsNotExist(backupErr) {
+			return err
+		}
+	}
+}
+
+func loadFile(db *DB, path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err == nil && !bytes.HasPrefix(buf, dbMagic) {
+		err = ErrCorrupt
+	}
+
+	if err == nil {
+		err = db.UnmarshalBinary(buf)
+	}
+	return err
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// writeFile replaces the file at path with buf.  The data is written to a
+// temporary file and synced before being renamed over path, so path always
+// holds either the old or the new contents.  The previous contents are
+// kept as the first of backups rotated backups
+func writeFile(path string, buf []byte, backups int) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && backups > 0 {
+		err = rotate(path, backups)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	} else {
+		os.Remove(tmp)
+	}
+
+	if err == nil {
+		syncDir(filepath.Dir(path))
+	}
+	return err
+}
+
+// rotate shifts path.1 through path.N-1 up by one and links path to path.1,
+// leaving path in place until it is replaced
+func rotate(path string, backups int) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := backups - 1; i > 0; i-- {
+		err := os.Rename(backupName(path, i), backupName(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	backup := backupName(path, 1)
+	os.Remove(backup)
+	if os.Link(path, backup) != nil {
+		// file systems without hard links briefly have no snapshot at path,
+		// LoadFile falls back to the backup in that case
+		return os.Rename(path, backup)
+	}
+	return nil
+}
+
+// syncDir syncs a directory so that renames within it are durable.  Not all
+// platforms support this, so errors are ignored
+func syncDir(dir string) {
+	if file, err := os.Open(dir); err == nil {
+		file.Sync()
+		file.Close()
+	}
+}
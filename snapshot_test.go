@@ -0,0 +1,105 @@
+package disgo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDBSaveFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.db")
+	db := New()
+	var saved []map[string]ImageInfo
+	for i, location := range []string{"a.png", "b.png", "c.png", "d.png"} {
+		db.putRecord(ImageInfo{Hash: PHash(i), Location: location})
+		if err := db.SaveFile(path, 2); err != nil {
+			t.Fatalf("Expected nil got %v", err)
+		}
+
+		saved = append(saved, testRecords(db))
+	}
+
+	tests := []struct {
+		path     string
+		expected map[string]ImageInfo
+	}{
+		{path, saved[3]},
+		{path + ".1", saved[2]},
+		{path + ".2", saved[1]},
+	}
+
+	for i, test := range tests {
+		loaded := New()
+		if err := loaded.LoadFile(test.path); err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+		} else if !reflect.DeepEqual(test.expected, testRecords(loaded)) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, testRecords(loaded))
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups got %v", err)
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be removed got %v", err)
+	}
+}
+
+func TestDBLoadFileFallback(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.db")
+	db := New()
+	db.putRecord(ImageInfo{Hash: 0x01, Location: "a.png"})
+	db.SaveFile(path, 1)
+	previous := map[string]ImageInfo{"a.png": testRecords(db)["a.png"]}
+	db.putRecord(ImageInfo{Hash: 0x02, Location: "b.png"})
+	db.SaveFile(path, 1)
+
+	// flip a bit in the newest snapshot's records
+	buf, _ := ioutil.ReadFile(path)
+	buf[len(buf)-20] ^= 0x01
+	ioutil.WriteFile(path, buf, 0644)
+
+	loaded := New()
+	if err := loaded.UnmarshalBinary(buf); err != ErrCorrupt {
+		t.Errorf("Expected %v got %v", ErrCorrupt, err)
+	}
+
+	if err := loaded.LoadFile(path); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	} else if !reflect.DeepEqual(previous, testRecords(loaded)) {
+		t.Errorf("Expected %v got %v", previous, testRecords(loaded))
+	}
+
+	// a damaged magic or a bare index isn't a snapshot, so the backup is
+	// loaded instead
+	buf, _ = ioutil.ReadFile(path + ".1")
+	buf[0] ^= 0xff
+	index, _ := BuildRadixIndex([]PHash{0x01}).MarshalBinary()
+	for i, test := range [][]byte{buf, index} {
+		ioutil.WriteFile(path, test, 0644)
+		loaded := New()
+		if err := loaded.LoadFile(path); err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+		} else if !reflect.DeepEqual(previous, testRecords(loaded)) {
+			t.Errorf("tests[%d] expected %v got %v", i, previous, testRecords(loaded))
+		}
+	}
+
+	os.Remove(path + ".1")
+	if err := New().LoadFile(path); err != ErrCorrupt {
+		t.Errorf("Expected %v got %v", ErrCorrupt, err)
+	}
+
+	if err := New().LoadFile(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error got %v", err)
+	}
+}
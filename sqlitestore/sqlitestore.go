@@ -0,0 +1,372 @@
+// Package sqlitestore provides a disgo.RecordStore that keeps records in a
+// SQLite database, where they can be queried with SQL.  Open uses the pure
+// Go driver from modernc.org/sqlite, so no cgo is needed, and New accepts a
+// database opened with any SQLite driver (version 3.24 or later).
+//
+// Records are stored in the records table:
+//
+//	location        TEXT PRIMARY KEY
+//	hash            INTEGER  the hash as a signed 64 bit integer
+//	size            INTEGER
+//	width           INTEGER
+//	height          INTEGER
+//	mtime           INTEGER  modification time in Unix nanoseconds, or NULL
+//	checksum        TEXT
+//	added           INTEGER  time the location was first stored in Unix nanoseconds
+//	id              INTEGER  the image ID
+//	low_information INTEGER  1 if the image is flagged as LowInformation
+//
+// and their tags in the tags table (location, tag)
+package sqlitestore
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/abates/disgo"
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS records (
+	location        TEXT PRIMARY KEY,
+	hash            INTEGER NOT NULL,
+	size            INTEGER NOT NULL,
+	width           INTEGER NOT NULL,
+	height          INTEGER NOT NULL,
+	mtime           INTEGER,
+	checksum        TEXT NOT NULL,
+	added           INTEGER NOT NULL,
+	id              INTEGER NOT NULL DEFAULT 0,
+	low_information INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS records_hash ON records (hash);
+CREATE TABLE IF NOT EXISTS tags (
+	location TEXT NOT NULL,
+	tag      TEXT NOT NULL,
+	PRIMARY KEY (location, tag)
+);
+CREATE INDEX IF NOT EXISTS tags_tag ON tags (tag);
+`
+
+const columns = "location, hash, size, width, height, mtime, checksum, id, low_information"
+
+// maxParams is the number of hashes or locations put in each query, which
+// keeps it under SQLite's limit on query parameters
+const maxParams = 500
+
+// Store is a disgo.RecordStore backed by a SQLite database
+type Store struct {
+	db *sql.DB
+
+	// Now returns the time recorded in the added column, it defaults to
+	// time.Now
+	Now func() time.Time
+}
+
+// Open opens (or creates) the SQLite database at path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := New(db)
+	if err != nil {
+		db.Close()
+	}
+	return store, err
+}
+
+// New creates the tables in db, if they don't already exist, and returns a
+// store that uses it
+func New(db *sql.DB) (*Store, error) {
+	_, err := db.Exec(schema)
+	if err == nil {
+		_, err = db.Exec("CREATE INDEX IF NOT EXISTS records_id ON records (id)")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db, Now: time.Now}, nil
+}
+
+type scanner interface {
+	Scan(...interface{}) error
+}
+
+func scan(row scanner) (info disgo.ImageInfo, err error) {
+	var hash, id int64
+	var mtime sql.NullInt64
+	err = row.Scan(&info.Location, &hash, &info.Size, &info.Width, &info.Height, &mtime, &info.Checksum, &id, &info.LowInformation)
+	info.Hash = disgo.PHash(hash)
+	info.ID = uint64(id)
+	if mtime.Valid {
+		info.ModTime = time.Unix(0, mtime.Int64)
+	}
+	return info, err
+}
+
+// tags fills in the tags for each record, querying them for up to
+// maxParams records at a time
+func (s *Store) tags(records []disgo.ImageInfo) error {
+	for len(records) > 0 {
+		n := len(records)
+		if n > maxParams {
+			n = maxParams
+		}
+
+		index := make(map[string]int, n)
+		params := make([]interface{}, n)
+		for i, info := range records[:n] {
+			index[info.Location] = i
+			params[i] = info.Location
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+		rows, err := s.db.Query("SELECT location, tag FROM tags WHERE location IN ("+placeholders+") ORDER BY location, tag", params...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var location, tag string
+			if err = rows.Scan(&location, &tag); err != nil {
+				break
+			}
+
+			if i, found := index[location]; found {
+				records[i].Tags = append(records[i].Tags, tag)
+			}
+		}
+
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+
+		if err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// query returns the records (with their tags) selected by query
+func (s *Store) query(query string, args ...interface{}) ([]disgo.ImageInfo, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []disgo.ImageInfo
+	for rows.Next() {
+		var info disgo.ImageInfo
+		if info, err = scan(rows); err != nil {
+			break
+		}
+		records = append(records, info)
+	}
+
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err == nil {
+		err = s.tags(records)
+	}
+	return records, err
+}
+
+func (s *Store) Get(location string) (disgo.ImageInfo, error) {
+	records, err := s.query("SELECT "+columns+" FROM records WHERE location = ?", location)
+	if err == nil && len(records) == 0 {
+		err = disgo.ErrNotFound
+	}
+
+	if err != nil {
+		return disgo.ImageInfo{}, err
+	}
+	return records[0], nil
+}
+
+func (s *Store) ID(id uint64) (disgo.ImageInfo, error) {
+	records, err := s.query("SELECT "+columns+" FROM records WHERE id = ? AND id != 0", int64(id))
+	if err == nil && len(records) == 0 {
+		err = disgo.ErrNotFound
+	}
+
+	if err != nil {
+		return disgo.ImageInfo{}, err
+	}
+	return records[0], nil
+}
+
+// upsert replaces every column of an existing record except added, which
+// keeps the time the location was first stored
+const upsert = `ON CONFLICT (location) DO UPDATE SET
+	hash = excluded.hash, size = excluded.size, width = excluded.width,
+	height = excluded.height, mtime = excluded.mtime, checksum = excluded.checksum,
+	id = excluded.id, low_information = excluded.low_information`
+
+// Put adds info, replacing any record with the same location.  The added
+// column of a replaced record is left as it was
+func (s *Store) Put(info disgo.ImageInfo) error {
+	var mtime sql.NullInt64
+	if !info.ModTime.IsZero() {
+		mtime = sql.NullInt64{Int64: info.ModTime.UnixNano(), Valid: true}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO records ("+columns+", added) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+upsert,
+		info.Location, int64(info.Hash), info.Size, info.Width, info.Height, mtime, info.Checksum, int64(info.ID), info.LowInformation, s.Now().UnixNano())
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM tags WHERE location = ?", info.Location)
+	}
+
+	for _, tag := range info.Tags {
+		if err == nil {
+			_, err = tx.Exec("INSERT OR IGNORE INTO tags (location, tag) VALUES (?, ?)", info.Location, tag)
+		}
+	}
+
+	if err == nil {
+		return tx.Commit()
+	}
+	tx.Rollback()
+	return err
+}
+
+func (s *Store) Delete(location string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM records WHERE location = ?", location)
+	if err == nil {
+		var n int64
+		if n, err = result.RowsAffected(); err == nil && n == 0 {
+			err = disgo.ErrNotFound
+		}
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM tags WHERE location = ?", location)
+	}
+
+	if err == nil {
+		return tx.Commit()
+	}
+	tx.Rollback()
+	return err
+}
+
+// Hash returns the records with hash, sorted by location
+func (s *Store) Hash(hash disgo.PHash) ([]disgo.ImageInfo, error) {
+	return s.query("SELECT "+columns+" FROM records WHERE hash = ? ORDER BY location", int64(hash))
+}
+
+// walkPage is the number of records Walk reads at a time
+const walkPage = 1000
+
+// Walk calls fn for the records in order of location.  They are read a
+// page at a time, so only a page is held in memory
+func (s *Store) Walk(fn func(disgo.ImageInfo) error) error {
+	records, err := s.query("SELECT "+columns+" FROM records ORDER BY location LIMIT ?", walkPage)
+	for err == nil && len(records) > 0 {
+		for _, info := range records {
+			if err = fn(info); err != nil {
+				return err
+			}
+		}
+
+		if len(records) < walkPage {
+			break
+		}
+
+		last := records[len(records)-1].Location
+		records, err = s.query("SELECT "+columns+" FROM records WHERE location > ? ORDER BY location LIMIT ?", last, walkPage)
+	}
+	return err
+}
+
+// Select returns the records matching the SQL expression where, which may
+// refer to any of the columns in the records table and use placeholders
+// for args.  For instance:
+//
+//	store.Select("location LIKE ? AND added > ?", "/photos/%", since.UnixNano())
+//
+// Tags can be matched with a subquery on the tags table.  An empty where
+// selects every record
+func (s *Store) Select(where string, args ...interface{}) ([]disgo.ImageInfo, error) {
+	query := "SELECT " + columns + " FROM records"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	return s.query(query+" ORDER BY location", args...)
+}
+
+// Hashes returns the records with any of the hashes, querying up to
+// maxParams hashes at a time
+func (s *Store) Hashes(hashes []disgo.PHash) ([]disgo.ImageInfo, error) {
+	return s.hashes(hashes, "")
+}
+
+// Search searches db for images within maxDistance of hash and returns the
+// records for the matches that also satisfy where (see Select)
+func (s *Store) Search(db *disgo.DB, hash disgo.PHash, maxDistance int, where string, args ...interface{}) ([]disgo.ImageInfo, error) {
+	matches, err := db.SearchByHash(hash, maxDistance)
+	if err != nil {
+		return nil, err
+	}
+	return s.hashes(matches, where, args...)
+}
+
+// hashes returns the records with any of the hashes that satisfy where
+func (s *Store) hashes(hashes []disgo.PHash, where string, args ...interface{}) ([]disgo.ImageInfo, error) {
+	condition := ""
+	if where != "" {
+		condition = " AND (" + where + ")"
+	}
+
+	var records []disgo.ImageInfo
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > maxParams {
+			n = maxParams
+		}
+
+		params := make([]interface{}, 0, n+len(args))
+		for _, hash := range hashes[:n] {
+			params = append(params, int64(hash))
+		}
+		params = append(params, args...)
+		hashes = hashes[n:]
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+		found, err := s.query("SELECT "+columns+" FROM records WHERE hash IN ("+placeholders+")"+condition+" ORDER BY location", params...)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	return records, nil
+}
+
+// Persistent returns true, the records are kept in the SQLite database
+func (s *Store) Persistent() bool { return true }
+
+// Close closes the SQLite database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
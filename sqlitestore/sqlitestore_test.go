@@ -0,0 +1,243 @@
+package sqlitestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abates/disgo"
+)
+
+func newTestStore(t *testing.T, dir string) *Store {
+	store, err := Open(filepath.Join(dir, "records.db"))
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	return store
+}
+
+func TestStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	store := newTestStore(t, dir)
+	defer store.Close()
+
+	mtime := time.Unix(1500000000, 42)
+	a := disgo.ImageInfo{ID: 7, Hash: 0xfedcba9876543210, Location: "a.png", Size: 37, ModTime: mtime, Checksum: "abcd", Width: 3, Height: 4, Tags: []string{"x", "y"}, LowInformation: true}
+	b := disgo.ImageInfo{Hash: 0xfedcba9876543210, Location: "b.png"}
+	c := disgo.ImageInfo{Hash: 0x43, Location: "c.png", Tags: []string{"y"}}
+	for _, info := range []disgo.ImageInfo{a, b, {Hash: 0x01, Location: "c.png", Tags: []string{"z"}}, c} {
+		if err := store.Put(info); err != nil {
+			t.Fatalf("Expected nil got %v", err)
+		}
+	}
+
+	if info, err := store.Get("a.png"); err != nil || !reflect.DeepEqual(info, a) {
+		t.Errorf("Expected %v got %v (%v)", a, info, err)
+	}
+
+	if _, err := store.Get("missing.png"); err != disgo.ErrNotFound {
+		t.Errorf("Expected %v got %v", disgo.ErrNotFound, err)
+	}
+
+	tests := []struct {
+		hash     disgo.PHash
+		expected []disgo.ImageInfo
+	}{
+		{0xfedcba9876543210, []disgo.ImageInfo{a, b}},
+		{0x43, []disgo.ImageInfo{c}},
+		{0x01, nil},
+	}
+
+	for i, test := range tests {
+		records, err := store.Hash(test.hash)
+		if err != nil || !reflect.DeepEqual(test.expected, records) {
+			t.Errorf("tests[%d] expected %v got %v (%v)", i, test.expected, records, err)
+		}
+	}
+
+	if err := store.Delete("b.png"); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+
+	if err := store.Delete("b.png"); err != disgo.ErrNotFound {
+		t.Errorf("Expected %v got %v", disgo.ErrNotFound, err)
+	}
+}
+
+func TestStoreTags(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	store := newTestStore(t, dir)
+	defer store.Close()
+
+	// more records than fit in one tags query
+	var expected []disgo.ImageInfo
+	for i := 0; i < maxParams+2; i++ {
+		info := disgo.ImageInfo{Hash: disgo.PHash(i), Location: fmt.Sprintf("%04d.png", i)}
+		if i%2 == 0 {
+			info.Tags = []string{fmt.Sprintf("tag%d", i), "x"}
+		}
+
+		if err := store.Put(info); err != nil {
+			t.Fatalf("Expected nil got %v", err)
+		}
+		expected = append(expected, info)
+	}
+
+	records, err := store.Select("")
+	if err != nil || !reflect.DeepEqual(expected, records) {
+		t.Errorf("Expected %d records with tags got %d (%v)", len(expected), len(records), err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "records.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	a := disgo.ImageInfo{ID: 1, Hash: 0x42, Location: "a.png"}
+	store.Put(a)
+	store.Close()
+
+	// the records are still there when the database is opened again
+	store, err = Open(path)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer store.Close()
+
+	if info, err := store.ID(1); err != nil || !reflect.DeepEqual(info, a) {
+		t.Errorf("Expected %v got %v (%v)", a, info, err)
+	}
+
+	if _, err := Open(dir); err == nil {
+		t.Errorf("Expected an error opening a directory")
+	}
+}
+
+func TestStorePutKeepsAdded(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	store := newTestStore(t, dir)
+	defer store.Close()
+
+	now := time.Unix(1000, 0)
+	store.Now = func() time.Time { return now }
+	store.Put(disgo.ImageInfo{Hash: 0x42, Location: "a.png", Tags: []string{"x"}})
+
+	now = time.Unix(2000, 0)
+	b := disgo.ImageInfo{ID: 3, Hash: 0x43, Location: "a.png", Size: 5, Tags: []string{"y"}}
+	store.Put(b)
+
+	if info, err := store.Get("a.png"); err != nil || !reflect.DeepEqual(info, b) {
+		t.Errorf("Expected %v got %v (%v)", b, info, err)
+	}
+
+	var added int64
+	store.db.QueryRow("SELECT added FROM records WHERE location = ?", "a.png").Scan(&added)
+	if expected := time.Unix(1000, 0).UnixNano(); expected != added {
+		t.Errorf("Expected %v got %v", expected, added)
+	}
+}
+
+func TestNewNumbersRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	store := newTestStore(t, dir)
+	defer store.Close()
+
+	// rows written with SQL rather than Put have no ID
+	_, err := store.db.Exec("INSERT INTO records (location, hash, size, width, height, checksum, added) VALUES ('a.png', 66, 0, 0, 0, '', 0)")
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if info, err := store.Get("a.png"); err != nil || info.ID != 0 || info.Hash != 66 {
+		t.Errorf("Expected a.png without an ID got %v (%v)", info, err)
+	}
+
+	// records are numbered when a DB is created from the store
+	disgo.NewDBWithStore(disgo.NewRadixIndex(), store)
+	if info, _ := store.Get("a.png"); info.ID != 1 {
+		t.Errorf("Expected 1 got %v", info.ID)
+	}
+}
+
+func TestStoreSelect(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	store := newTestStore(t, dir)
+	added := time.Unix(1000, 0)
+	store.Now = func() time.Time { return added }
+
+	db, _ := disgo.NewDBWithStore(disgo.NewRadixIndex(), store)
+	defer db.Close()
+
+	records := []disgo.ImageInfo{
+		{Hash: 0x00, Location: "/photos/a.png", Tags: []string{"holiday"}},
+		{Hash: 0x01, Location: "/photos/b.png"},
+		{Hash: 0x03, Location: "/scans/c.png", Tags: []string{"holiday"}},
+		{Hash: 0xff, Location: "/photos/d.png"},
+	}
+
+	for i, info := range records {
+		added = time.Unix(int64(1000*(i+1)), 0)
+		store.Put(info)
+		db.AddHash(info.Hash)
+	}
+
+	tests := []struct {
+		where     string
+		args      []interface{}
+		locations []string
+	}{
+		{"", nil, []string{"/photos/a.png", "/photos/b.png", "/photos/d.png", "/scans/c.png"}},
+		{"location LIKE ?", []interface{}{"/photos/%"}, []string{"/photos/a.png", "/photos/b.png", "/photos/d.png"}},
+		{"added > ?", []interface{}{time.Unix(2000, 0).UnixNano()}, []string{"/photos/d.png", "/scans/c.png"}},
+		{"location IN (SELECT location FROM tags WHERE tag = ?)", []interface{}{"holiday"}, []string{"/photos/a.png", "/scans/c.png"}},
+	}
+
+	for i, test := range tests {
+		var locations []string
+		found, err := store.Select(test.where, test.args...)
+		for _, info := range found {
+			locations = append(locations, info.Location)
+		}
+
+		if err != nil || !reflect.DeepEqual(test.locations, locations) {
+			t.Errorf("tests[%d] expected %v got %v (%v)", i, test.locations, locations, err)
+		}
+	}
+
+	found, err := store.Search(db, 0x00, 2, "location LIKE ?", "/photos/%")
+	var locations []string
+	for _, info := range found {
+		locations = append(locations, info.Location)
+	}
+
+	expected := []string{"/photos/a.png", "/photos/b.png"}
+	if err != nil || !reflect.DeepEqual(expected, locations) {
+		t.Errorf("Expected %v got %v (%v)", expected, locations, err)
+	}
+
+	// filtered searches look up the records with Hashes
+	hashes, err := db.SearchByHashFilter(0x00, 2, disgo.FilterTags("holiday"))
+	if expected := []disgo.PHash{0x00, 0x03}; err != nil || !reflect.DeepEqual(expected, hashes) {
+		t.Errorf("Expected %v got %v (%v)", expected, hashes, err)
+	}
+}
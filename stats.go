@@ -0,0 +1,203 @@
+package disgo
+
+import (
+	"sort"
+	"unsafe"
+)
+
+// commonHashes is the number of hashes reported in IndexStats.Common
+const commonHashes = 10
+
+// IndexStats describes the hashes in an index and how they are stored.  A
+// heavily unbalanced bit, or a single hash shared by many images (such as
+// the all zero hash of blank images), slows searches down and usually
+// means the hashes aren't telling the images apart
+type IndexStats struct {
+	// Hashes is the number of distinct hashes and Entries the number of
+	// times they were inserted
+	Hashes  int `json:"hashes"`
+	Entries int `json:"entries"`
+
+	// Nodes is the number of nodes in a tree index, and Depths[d] the
+	// number of leaves d nodes below the root
+	Nodes  int   `json:"nodes"`
+	Depths []int `json:"depths,omitempty"`
+
+	// Bytes is roughly the memory used by the index
+	Bytes int64 `json:"bytes"`
+
+	// Bits[i] is the number of entries with bit i (counting from the least
+	// significant) set.  Bits of a well balanced hash are set in about half
+	// of the entries
+	Bits [64]int `json:"bits"`
+
+	// Common are the most inserted hashes, most common first
+	Common []Match `json:"common,omitempty"`
+}
+
+// StatsIndex is implemented by indexes that can describe their contents
+type StatsIndex interface {
+	Stats() IndexStats
+}
+
+// add records count entries of hash in a leaf depth nodes below the root
+func (stats *IndexStats) add(hash PHash, count, depth int) {
+	stats.Hashes++
+	stats.Entries += count
+	for i := range stats.Bits {
+		if hash>>uint(i)&1 == 1 {
+			stats.Bits[i] += count
+		}
+	}
+
+	if depth >= 0 {
+		for len(stats.Depths) <= depth {
+			stats.Depths = append(stats.Depths, 0)
+		}
+		stats.Depths[depth]++
+	}
+
+	i := sort.Search(len(stats.Common), func(i int) bool {
+		common := stats.Common[i]
+		return common.Count < count || (common.Count == count && common.Hash > hash)
+	})
+
+	if i < commonHashes {
+		if len(stats.Common) < commonHashes {
+			stats.Common = append(stats.Common, Match{})
+		}
+		copy(stats.Common[i+1:], stats.Common[i:])
+		stats.Common[i] = Match{Hash: hash, Count: count}
+	}
+}
+
+// size estimates the memory used by the posting lists
+func (p postings) size() int64 {
+	var size int64
+	for _, ids := range p {
+		size += int64(unsafe.Sizeof(PHash(0))+unsafe.Sizeof(ids)) + 8*int64(cap(ids))
+	}
+	return size
+}
+
+func (ri *RadixIndex) Stats() IndexStats {
+	var stats IndexStats
+	if root, ok := ri.root.(*Node); ok {
+		root.stats(&stats, 0, 0)
+	}
+	stats.Bytes = int64(stats.Nodes)*int64(unsafe.Sizeof(Node{})) + ri.postings.size()
+	return stats
+}
+
+// stats adds the subtree at n, which is depth nodes below the root and
+// whose path from the root spells match, to stats
+func (n *Node) stats(stats *IndexStats, match PHash, depth int) {
+	if n.length == 0 && n.IsLeaf() {
+		return
+	}
+
+	stats.Nodes++
+	if n.length > 0 {
+		match = match<<n.length | n.prefix>>(64-n.length)
+	}
+
+	if n.IsLeaf() {
+		stats.add(match, n.Count(), depth)
+		return
+	}
+
+	for _, child := range []*Node{n.left, n.right} {
+		if child != nil {
+			child.stats(stats, match, depth+1)
+		}
+	}
+}
+
+func (ci *CompactRadixIndex) Stats() IndexStats {
+	var stats IndexStats
+	if ci.count() > 0 {
+		ci.stats(&stats, 0, 0, 0)
+	}
+	stats.Bytes = int64(len(ci.nodes))
+	return stats
+}
+
+func (ci *CompactRadixIndex) stats(stats *IndexStats, i int32, match PHash, depth int) {
+	length, flags := ci.length(i), ci.flags(i)
+	if length == 0 && !flags.HasLeft() && !flags.HasRight() {
+		return
+	}
+
+	stats.Nodes++
+	if length > 0 {
+		match = match<<length | ci.prefix(i)>>(64-length)
+	}
+
+	if !flags.HasLeft() && !flags.HasRight() {
+		stats.add(match, int(ci.duplicates(i))+1, depth)
+		return
+	}
+
+	if flags.HasLeft() {
+		ci.stats(stats, i+1, match, depth+1)
+	}
+
+	if flags.HasRight() {
+		ci.stats(stats, ci.right(i), match, depth+1)
+	}
+}
+
+func (li *LinearIndex) Stats() IndexStats {
+	var stats IndexStats
+	for hash, count := range li.entries {
+		stats.add(hash, count, -1)
+	}
+	stats.Bytes = int64(len(li.entries))*int64(unsafe.Sizeof(PHash(0))+unsafe.Sizeof(0)) + li.postings.size()
+	return stats
+}
+
+// Stats describes the database and its index
+type Stats struct {
+	Index   IndexStats `json:"index"`
+	Records int        `json:"records"`
+
+	// LowInformation is the number of records flagged as LowInformation
+	LowInformation int `json:"low_information"`
+
+	// Collections holds the stats of each named collection
+	Collections map[string]Stats `json:"collections,omitempty"`
+}
+
+// Stats describes the database.  It returns ErrNotSupported if the index
+// (or a collection's index) doesn't implement StatsIndex
+func (db *DB) Stats() (Stats, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var stats Stats
+	index, ok := db.index.(StatsIndex)
+	if !ok {
+		return stats, ErrNotSupported
+	}
+	stats.Index = index.Stats()
+
+	err := db.records.Walk(func(info ImageInfo) error {
+		stats.Records++
+		if info.LowInformation {
+			stats.LowInformation++
+		}
+		return nil
+	})
+
+	for name, collection := range db.collections {
+		if err != nil {
+			break
+		}
+
+		if stats.Collections == nil {
+			stats.Collections = make(map[string]Stats)
+		}
+		stats.Collections[name], err = collection.Stats()
+	}
+	return stats, err
+}
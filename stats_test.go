@@ -0,0 +1,81 @@
+package disgo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIndexStats(t *testing.T) {
+	hashes := []PHash{0x00, 0x03, 0x00, 0x01, 0x00}
+	radix := BuildRadixIndex(hashes)
+	linear := NewLinearIndex()
+	for _, hash := range hashes {
+		linear.Insert(hash)
+	}
+
+	// root -> 62 zeros -> {0 -> {0x00, 0x01}, 0x03}
+	expected := IndexStats{
+		Hashes:  3,
+		Entries: 5,
+		Nodes:   6,
+		Depths:  []int{0, 0, 1, 2},
+		Common:  []Match{{0x00, 0, 3, nil}, {0x01, 0, 1, nil}, {0x03, 0, 1, nil}},
+	}
+	expected.Bits[0] = 2
+	expected.Bits[1] = 1
+
+	tests := []struct {
+		index StatsIndex
+		tree  bool
+	}{
+		{radix, true},
+		{radix.Compact(), true},
+		{linear, false},
+	}
+
+	for i, test := range tests {
+		stats := test.index.Stats()
+		if stats.Bytes <= 0 {
+			t.Errorf("tests[%d] expected a memory footprint got %d", i, stats.Bytes)
+		}
+
+		stats.Bytes = 0
+		want := expected
+		if !test.tree {
+			want.Nodes, want.Depths = 0, nil
+		}
+
+		if !reflect.DeepEqual(want, stats) {
+			t.Errorf("tests[%d] expected %+v got %+v", i, want, stats)
+		}
+	}
+
+	if stats := NewRadixIndex().Stats(); stats.Nodes != 0 || stats.Hashes != 0 {
+		t.Errorf("Expected empty stats got %+v", stats)
+	}
+}
+
+func TestDBStats(t *testing.T) {
+	db := New()
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "a.png"})
+	db.addRecord(ImageInfo{Hash: 0x01, Location: "b.png"})
+	db.AddHash(0x02)
+	db.Collection("photos").addRecord(ImageInfo{Hash: 0x03, Location: "c.png"})
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if stats.Records != 2 || stats.Index.Hashes != 2 || stats.Index.Entries != 3 {
+		t.Errorf("Expected 2 records and 2 hashes with 3 entries got %+v", stats)
+	}
+
+	if photos := stats.Collections["photos"]; photos.Records != 1 || photos.Index.Hashes != 1 {
+		t.Errorf("Expected 1 record and 1 hash got %+v", photos)
+	}
+
+	if _, err := NewDB(newTestIndex()).Stats(); err != ErrNotSupported {
+		t.Errorf("Expected %v got %v", ErrNotSupported, err)
+	}
+}
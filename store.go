@@ -0,0 +1,139 @@
+package disgo
+
+import (
+	"sort"
+)
+
+// RecordStore holds the ImageInfo records for a DB, keyed by location.
+// The DB serializes access to its store, so implementations don't need to
+// be safe for concurrent use
+type RecordStore interface {
+	// Get returns the record for location, or ErrNotFound
+	Get(location string) (ImageInfo, error)
+
+	// ID returns the record with the given (non-zero) ID, or ErrNotFound
+	ID(id uint64) (ImageInfo, error)
+
+	// Put adds info, replacing any record with the same location
+	Put(info ImageInfo) error
+
+	// Delete removes the record for location, or returns ErrNotFound
+	Delete(location string) error
+
+	// Hash returns every record with the given hash
+	Hash(hash PHash) ([]ImageInfo, error)
+
+	// Walk calls fn for every record until fn returns an error, which Walk
+	// then returns.  fn must not modify the store
+	Walk(fn func(ImageInfo) error) error
+}
+
+// PersistentStore is implemented by record stores that keep their records
+// themselves, such as on disk, when Persistent returns true.  A saved
+// database leaves their records out, and loading one leaves the store as
+// it is and indexes the records already in it.  To move the records of a
+// snapshot into such a store, load it into a database of its own and Merge
+// that in
+type PersistentStore interface {
+	RecordStore
+	Persistent() bool
+}
+
+func persistent(store RecordStore) bool {
+	p, ok := store.(PersistentStore)
+	return ok && p.Persistent()
+}
+
+// HashesStore is implemented by record stores that can look up the records
+// for many hashes at once.  Filtered searches use it, when the store has
+// it, instead of calling Hash for every match
+type HashesStore interface {
+	RecordStore
+
+	// Hashes returns every record with one of the hashes
+	Hashes(hashes []PHash) ([]ImageInfo, error)
+}
+
+// MemoryStore is a RecordStore that keeps its records in memory.  It is
+// the store used by New and NewDB
+type MemoryStore struct {
+	records map[string]ImageInfo
+	hashes  map[PHash]map[string]bool
+	ids     map[uint64]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]ImageInfo),
+		hashes:  make(map[PHash]map[string]bool),
+		ids:     make(map[uint64]string),
+	}
+}
+
+func (ms *MemoryStore) Get(location string) (ImageInfo, error) {
+	if info, found := ms.records[location]; found {
+		return info, nil
+	}
+	return ImageInfo{}, ErrNotFound
+}
+
+func (ms *MemoryStore) ID(id uint64) (ImageInfo, error) {
+	if location, found := ms.ids[id]; found && id != 0 {
+		return ms.records[location], nil
+	}
+	return ImageInfo{}, ErrNotFound
+}
+
+func (ms *MemoryStore) Put(info ImageInfo) error {
+	ms.Delete(info.Location)
+	ms.records[info.Location] = info
+	if info.ID != 0 {
+		ms.ids[info.ID] = info.Location
+	}
+	if ms.hashes[info.Hash] == nil {
+		ms.hashes[info.Hash] = make(map[string]bool)
+	}
+	ms.hashes[info.Hash][info.Location] = true
+	return nil
+}
+
+func (ms *MemoryStore) Delete(location string) error {
+	info, found := ms.records[location]
+	if !found {
+		return ErrNotFound
+	}
+
+	delete(ms.records, location)
+	if ms.ids[info.ID] == location {
+		delete(ms.ids, info.ID)
+	}
+
+	delete(ms.hashes[info.Hash], location)
+	if len(ms.hashes[info.Hash]) == 0 {
+		delete(ms.hashes, info.Hash)
+	}
+	return nil
+}
+
+// Hash returns the records with hash, sorted by location
+func (ms *MemoryStore) Hash(hash PHash) ([]ImageInfo, error) {
+	var records []ImageInfo
+	for location := range ms.hashes[hash] {
+		records = append(records, ms.records[location])
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Location < records[j].Location })
+	return records, nil
+}
+
+// Walk calls fn for the records in no particular order
+func (ms *MemoryStore) Walk(fn func(ImageInfo) error) error {
+	for _, info := range ms.records {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of records in the store
+func (ms *MemoryStore) Len() int { return len(ms.records) }
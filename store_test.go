@@ -0,0 +1,100 @@
+package disgo
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testRecords returns a copy of every record in db keyed by location
+func testRecords(db *DB) map[string]ImageInfo {
+	records := make(map[string]ImageInfo)
+	db.records.Walk(func(info ImageInfo) error {
+		records[info.Location] = info
+		return nil
+	})
+	return records
+}
+
+// persistentStore is a MemoryStore that claims to keep its own records
+type persistentStore struct {
+	*MemoryStore
+}
+
+func (persistentStore) Persistent() bool { return true }
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	a := ImageInfo{Hash: 0x42, Location: "a.png", Size: 37}
+	b := ImageInfo{Hash: 0x42, Location: "b.png"}
+	c := ImageInfo{Hash: 0x43, Location: "c.png"}
+	for _, info := range []ImageInfo{b, a, {Hash: 0x01, Location: "c.png"}, c} {
+		store.Put(info)
+	}
+
+	if info, err := store.Get("a.png"); err != nil || !reflect.DeepEqual(info, a) {
+		t.Errorf("Expected %v got %v (%v)", a, info, err)
+	}
+
+	if _, err := store.Get("missing.png"); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	tests := []struct {
+		hash     PHash
+		expected []ImageInfo
+	}{
+		{0x42, []ImageInfo{a, b}},
+		{0x43, []ImageInfo{c}},
+		{0x01, nil},
+	}
+
+	for i, test := range tests {
+		records, _ := store.Hash(test.hash)
+		if !reflect.DeepEqual(test.expected, records) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, records)
+		}
+	}
+
+	store.Delete("b.png")
+	if err := store.Delete("b.png"); err != ErrNotFound {
+		t.Errorf("Expected %v got %v", ErrNotFound, err)
+	}
+
+	store.Put(ImageInfo{ID: 3, Hash: 0x44, Location: "d.png"})
+	if info, err := store.ID(3); err != nil || info.Location != "d.png" {
+		t.Errorf("Expected d.png got %v (%v)", info, err)
+	}
+
+	store.Delete("d.png")
+	for _, id := range []uint64{0, 3} {
+		if _, err := store.ID(id); err != ErrNotFound {
+			t.Errorf("Expected %v got %v", ErrNotFound, err)
+		}
+	}
+
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 records got %d", store.Len())
+	}
+}
+
+func TestNewDBWithStore(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(ImageInfo{Hash: 0x42, Location: "a.png"})
+	store.Put(ImageInfo{Hash: 0x42, Location: "b.png"})
+	db, err := NewDBWithStore(NewRadixIndex(), store)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if matches, _ := db.SearchByHash(0x42, 0); len(matches) != 1 {
+		t.Errorf("Expected 1 match got %v", matches)
+	}
+
+	// the hash stays in the index until its last record is removed
+	for i, expected := range []int{1, 0} {
+		db.RemovePath([]string{"a.png", "b.png"}[i])
+		if matches, _ := db.SearchByHash(0x42, 0); len(matches) != expected {
+			t.Errorf("tests[%d] expected %d matches got %v", i, expected, matches)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package disgo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	ErrNoWAL      = errors.New("Database does not have a write-ahead log")
+	ErrNoSnapshot = errors.New("Write-ahead log does not have a snapshot file")
+)
+
+// WALOptions configures the write-ahead log opened by OpenWAL
+type WALOptions struct {
+	// Snapshot is the file the database is saved to when the log is
+	// checkpointed
+	Snapshot string
+
+	// Backups is the number of previous snapshots to keep (see SaveFile)
+	Backups int
+
+	// CheckpointAfter is the number of entries after which the log is
+	// automatically checkpointed into Snapshot.  Entries written by
+	// collections count too, but the checkpoint waits for the next change
+	// to the database itself.  Zero, or an empty Snapshot, disables
+	// automatic checkpoints
+	CheckpointAfter int
+
+	// Sync waits for each entry to reach the disk before the change that
+	// wrote it returns.  Without it entries survive the process crashing,
+	// but not the machine
+	Sync bool
+}
+
+const (
+	walInsert           = "insert"
+	walAdd              = "add"
+	walRemove           = "remove"
+	walRemoveCollection = "removecollection"
+	walImport           = "import"
+	walSetCollection    = "setcollection"
+)
+
+// walEntry is a single change, stored as a line of JSON in the log.  Seq
+// numbers the entries, from one, in the order they were written.
+// Collection is the path to the collection that made the change, and is
+// empty for the database that opened the log
+type walEntry struct {
+	Seq        uint64      `json:"seq"`
+	Collection []string    `json:"collection,omitempty"`
+	Op         string      `json:"op"`
+	Name       string      `json:"name,omitempty"`
+	Hashes     []PHash     `json:"hashes,omitempty"`
+	Info       *ImageInfo  `json:"info,omitempty"`
+	Records    []ImageInfo `json:"records,omitempty"`
+}
+
+// wal is shared by the database that opened it and its collections.  Its
+// mutex guards the file and counters, which collections write to while
+// holding only their own lock
+type wal struct {
+	WALOptions
+	path    string
+	mutex   sync.Mutex
+	file    *os.File
+	entries int
+
+	// seq is the sequence number of the last entry written or replayed
+	seq uint64
+}
+
+// OpenWAL opens (or creates) the write-ahead log at path and replays it
+// into the database.  From then on every change to the database is
+// appended to the log before it returns, and the log is replayed again
+// whenever the database is loaded, so the log and the most recent snapshot
+// together always hold every change.  Collections, including those added
+// later, write their changes to the same log.  Snapshots record the last
+// entry they include and replaying skips the entries up to it, so entries
+// are never applied twice, such as when a crash interrupts a checkpoint.
+// An entry left incomplete by a crash is discarded
+func (db *DB) OpenWAL(path string, options WALOptions) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.wal != nil && len(db.walPath) == 0 {
+		db.wal.file.Close()
+	}
+
+	db.setWAL(&wal{WALOptions: options, path: path, file: file}, nil)
+	if err = db.replay(); err != nil {
+		file.Close()
+		db.setWAL(nil, nil)
+	}
+	return err
+}
+
+// setWAL makes db and its collections write to w, db as the collection at
+// path.  A nil w detaches them from the log
+func (db *DB) setWAL(w *wal, path []string) {
+	db.wal, db.walPath = w, path
+	for name, collection := range db.collections {
+		collection.mutex.Lock()
+		if w == nil {
+			collection.setWAL(nil, nil)
+		} else {
+			collection.setWAL(w, append(path[:len(path):len(path)], name))
+		}
+		collection.mutex.Unlock()
+	}
+}
+
+// lastSeq returns the sequence number of the last entry included in db or
+// any of its collections
+func (db *DB) lastSeq() uint64 {
+	seq := db.seq
+	for _, collection := range db.collections {
+		collection.mutex.RLock()
+		if s := collection.lastSeq(); s > seq {
+			seq = s
+		}
+		collection.mutex.RUnlock()
+	}
+	return seq
+}
+
+// replay applies every entry in the log to the database
+func (db *DB) replay() error {
+	w := db.wal
+	stat, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	entries := 0
+	seq := db.lastSeq()
+	w.mutex.Lock()
+	if seq > w.seq {
+		w.seq = seq
+	}
+	w.mutex.Unlock()
+
+	reader := bufio.NewReader(io.NewSectionReader(w.file, 0, stat.Size()))
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			w.entries = entries
+			if len(line) > 0 {
+				return w.file.Truncate(offset)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var entry walEntry
+		if json.Unmarshal(line, &entry) != nil || entry.Seq == 0 {
+			return ErrCorrupt
+		}
+
+		if err = db.replayEntry(entry); err != nil {
+			return err
+		}
+
+		w.mutex.Lock()
+		if entry.Seq > w.seq {
+			w.seq = entry.Seq
+		}
+		w.mutex.Unlock()
+		offset += int64(len(line))
+		entries++
+	}
+}
+
+// replayEntry applies entry to the collection that made it, unless the
+// collection already includes it.  db must be locked by the caller, its
+// collections are locked here
+func (db *DB) replayEntry(entry walEntry) error {
+	target := db
+	for _, name := range entry.Collection {
+		if target != db {
+			target.mutex.Lock()
+		}
+		collection := target.collection(name)
+		if target != db {
+			target.mutex.Unlock()
+		}
+		target = collection
+	}
+
+	if target != db {
+		target.mutex.Lock()
+		defer target.mutex.Unlock()
+	}
+
+	// entries up to target.seq are already in the loaded snapshot
+	if entry.Seq <= target.seq {
+		return nil
+	}
+
+	// replayed entries must not be logged again
+	w := target.wal
+	target.wal = nil
+	err := target.apply(entry)
+	target.wal = w
+
+	// a collection set while the log was detached needs attaching to it
+	if err == nil && entry.Op == walSetCollection {
+		target.setWAL(w, target.walPath)
+	}
+
+	if err == nil {
+		target.seq = entry.Seq
+	}
+	return err
+}
+
+// apply makes the change described by entry.  A PersistentStore keeps its
+// own changes, so after a crash it may already hold the records that
+// entries add or remove; record changes are therefore applied as
+// replacements
+func (db *DB) apply(entry walEntry) (err error) {
+	if (entry.Op == walAdd || entry.Op == walRemove) && entry.Info == nil {
+		return ErrCorrupt
+	}
+
+	switch entry.Op {
+	case walInsert:
+		for _, hash := range entry.Hashes {
+			if err == nil {
+				err = db.index.Insert(hash)
+			}
+		}
+	case walAdd:
+		if previous, getErr := db.records.Get(entry.Info.Location); getErr == nil {
+			err = db.removeRecord(previous)
+		}
+
+		if err == nil {
+			_, err = db.addRecord(*entry.Info)
+		}
+	case walRemove:
+		if previous, getErr := db.records.Get(entry.Info.Location); getErr == nil {
+			err = db.removeRecord(previous)
+		}
+	case walImport:
+		err = db.importBatch(entry.Records, entry.Hashes)
+	case walSetCollection:
+		db.setCollection(entry.Name, New())
+	case walRemoveCollection:
+		if _, found := db.collections[entry.Name]; found {
+			err = db.removeCollection(entry.Name)
+		}
+	default:
+		err = ErrCorrupt
+	}
+	return err
+}
+
+// log appends entry to the write-ahead log, if there is one, and
+// checkpoints the log once it has CheckpointAfter entries
+func (db *DB) log(entry walEntry) error {
+	w := db.wal
+	if w == nil {
+		return nil
+	}
+
+	w.mutex.Lock()
+	entry.Seq = w.seq + 1
+	entry.Collection = db.walPath
+	buf, err := json.Marshal(entry)
+	if err == nil {
+		_, err = w.file.Write(append(buf, '\n'))
+	}
+
+	if err == nil {
+		w.seq, db.seq = entry.Seq, entry.Seq
+	}
+
+	if err == nil && w.Sync {
+		err = w.file.Sync()
+	}
+
+	checkpoint := false
+	if err == nil {
+		w.entries++
+		checkpoint = len(db.walPath) == 0 && w.Snapshot != "" && w.CheckpointAfter > 0 && w.entries >= w.CheckpointAfter
+	}
+	w.mutex.Unlock()
+
+	// the checkpoint needs the collections' locks, which their writers
+	// hold while waiting for w.mutex
+	if checkpoint {
+		err = db.checkpoint()
+	}
+	return err
+}
+
+// Checkpoint saves the database to the log's snapshot file and empties the
+// log.  Collections share the log of their database and return ErrNoWAL
+func (db *DB) Checkpoint() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.wal == nil || len(db.walPath) > 0 {
+		return ErrNoWAL
+	}
+	return db.checkpoint()
+}
+
+func (db *DB) checkpoint() error {
+	w := db.wal
+	if w.Snapshot == "" {
+		return ErrNoSnapshot
+	}
+
+	// collections may write entries while the snapshot is taken, those
+	// after start are kept since the snapshot might not include them
+	w.mutex.Lock()
+	stat, err := w.file.Stat()
+	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	start := stat.Size()
+
+	buf, err := db.marshalBinary()
+	if err == nil {
+		err = writeFile(w.Snapshot, buf, w.Backups)
+	}
+
+	if err == nil {
+		w.mutex.Lock()
+		err = w.discard(start)
+		w.mutex.Unlock()
+	}
+	return err
+}
+
+// discard removes the first n bytes of entries from the log.  Any entries
+// after them are written to a new log that replaces the file, so a crash
+// can't lose them
+func (w *wal) discard(n int64) error {
+	stat, err := w.file.Stat()
+	if err != nil {
+		return err
+	} else if stat.Size() == n {
+		err = w.file.Truncate(0)
+		if err == nil {
+			err = w.file.Sync()
+		}
+
+		if err == nil {
+			w.entries = 0
+		}
+		return err
+	}
+
+	rest := make([]byte, stat.Size()-n)
+	if _, err = w.file.ReadAt(rest, n); err != nil {
+		return err
+	}
+
+	if err = writeFile(w.path, rest, 0); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.entries = bytes.Count(rest, []byte("\n"))
+	return nil
+}
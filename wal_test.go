@@ -0,0 +1,391 @@
+package disgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDBWAL(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.wal")
+	db := New()
+	if err := db.OpenWAL(path, WALOptions{}); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	db.AddHash(0x01)
+	db.AddHashes([]PHash{0x02, 0x03})
+	db.putRecord(ImageInfo{Hash: 0x42, Location: "a.png"})
+	db.putRecord(ImageInfo{Hash: 0x43, Location: "b.png"})
+	db.putRecord(ImageInfo{Hash: 0x44, Location: "b.png"})
+	db.putRecord(ImageInfo{Hash: 0x45, Location: "c.png"})
+	db.RemovePath("c.png")
+	db.Close()
+
+	// simulate a crash part way through writing an entry
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte(`{"op":"add","info":{"ha`))
+	file.Close()
+
+	replayed := New()
+	if err := replayed.OpenWAL(path, WALOptions{}); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer replayed.Close()
+
+	if !reflect.DeepEqual(testRecords(db), testRecords(replayed)) {
+		t.Errorf("Expected %v got %v", testRecords(db), testRecords(replayed))
+	}
+
+	for _, hash := range []PHash{0x01, 0x02, 0x03, 0x42, 0x44} {
+		if matches, _ := replayed.SearchByHash(hash, 0); len(matches) != 1 {
+			t.Errorf("Expected %v to be replayed got %v", hash, matches)
+		}
+	}
+
+	for _, hash := range []PHash{0x43, 0x45} {
+		if matches, _ := replayed.SearchByHash(hash, 0); len(matches) != 0 {
+			t.Errorf("Expected %v to be removed got %v", hash, matches)
+		}
+	}
+
+	// the incomplete entry is discarded so that new entries can follow
+	replayed.AddHash(0x37)
+	replayed.Close()
+	if err := New().OpenWAL(path, WALOptions{}); err != nil {
+		t.Errorf("Expected nil got %v", err)
+	}
+}
+
+func TestDBWALImport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.wal")
+	db := New()
+	if err := db.OpenWAL(path, WALOptions{}); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	db.putRecord(ImageInfo{Hash: 0x42, Location: "a.png"})
+	input := `{"hash":"0000000000000001","count":2}
+{"hash":"0000000000000043","location":"a.png"}
+{"hash":"0000000000000044","location":"b.png"}
+`
+	if err := db.ImportJSON(strings.NewReader(input)); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	db.Close()
+
+	// the import is logged as a single entry
+	buf, _ := ioutil.ReadFile(path)
+	if lines := bytes.Count(buf, []byte("\n")); lines != 2 {
+		t.Errorf("Expected 2 entries got %d", lines)
+	}
+
+	replayed := New()
+	if err := replayed.OpenWAL(path, WALOptions{}); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer replayed.Close()
+
+	if !reflect.DeepEqual(testRecords(db), testRecords(replayed)) {
+		t.Errorf("Expected %v got %v", testRecords(db), testRecords(replayed))
+	}
+
+	tests := []struct {
+		hash  PHash
+		count int
+	}{
+		{0x01, 2},
+		{0x42, 0},
+		{0x43, 1},
+		{0x44, 1},
+	}
+
+	for i, test := range tests {
+		count := 0
+		replayed.SearchFunc(test.hash, 0, func(match Match) bool {
+			count = match.Count
+			return true
+		})
+
+		if count != test.count {
+			t.Errorf("tests[%d] expected %v got %v", i, test.count, count)
+		}
+	}
+}
+
+func TestDBWALCheckpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.wal")
+	options := WALOptions{Snapshot: filepath.Join(dir, "test.db"), CheckpointAfter: 3, Sync: true}
+	db := New()
+	db.OpenWAL(path, options)
+	for i, location := range []string{"a.png", "b.png", "c.png", "d.png"} {
+		db.putRecord(ImageInfo{Hash: PHash(i), Location: location})
+	}
+	db.Close()
+
+	if buf, _ := ioutil.ReadFile(path); bytes.Count(buf, []byte("\n")) != 1 {
+		t.Errorf("Expected 1 entry after the checkpoint got %q", buf)
+	}
+
+	// the log can be opened before or after the snapshot is loaded
+	for i, walFirst := range []bool{false, true} {
+		loaded := New()
+		if walFirst {
+			loaded.OpenWAL(path, options)
+		}
+
+		snapshot, _ := os.Open(options.Snapshot)
+		if err := loaded.Load(snapshot); err != nil {
+			t.Errorf("tests[%d] expected nil got %v", i, err)
+		}
+		snapshot.Close()
+
+		if !walFirst {
+			loaded.OpenWAL(path, options)
+		}
+
+		if !reflect.DeepEqual(testRecords(db), testRecords(loaded)) {
+			t.Errorf("tests[%d] expected %v got %v", i, testRecords(db), testRecords(loaded))
+		}
+		loaded.Close()
+	}
+
+	if err := New().Checkpoint(); err != ErrNoWAL {
+		t.Errorf("Expected %v got %v", ErrNoWAL, err)
+	}
+
+	db = New()
+	db.OpenWAL(path, WALOptions{})
+	defer db.Close()
+	if err := db.Checkpoint(); err != ErrNoSnapshot {
+		t.Errorf("Expected %v got %v", ErrNoSnapshot, err)
+	}
+}
+
+func TestDBWALInterruptedCheckpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.wal")
+	options := WALOptions{Snapshot: filepath.Join(dir, "test.db")}
+	db := New()
+	db.OpenWAL(path, options)
+	db.AddHash(0x01)
+	db.Checkpoint()
+	db.AddHash(0x02)
+	db.AddHashes([]PHash{0x02, 0x03})
+	db.putRecord(ImageInfo{Hash: 0x42, Location: "a.png"})
+
+	// a crash after the snapshot is written but before the log is emptied
+	buf, _ := db.MarshalBinary()
+	writeFile(options.Snapshot, buf, 0)
+	db.AddHash(0x04)
+	db.Close()
+
+	// a snapshot saved while the log is open only includes some entries
+	saved := filepath.Join(dir, "saved.db")
+	expected := []Match{{0x01, 0, 1, nil}, {0x02, 0, 2, nil}, {0x03, 0, 1, nil}, {0x04, 0, 1, nil}, {0x42, 0, 1, []uint64{1}}}
+	for i, snapshot := range []string{options.Snapshot, saved} {
+		loaded := New()
+		if err := loaded.LoadFile(snapshot); err != nil {
+			t.Fatalf("tests[%d] expected nil got %v", i, err)
+		}
+
+		if err := loaded.OpenWAL(path, options); err != nil {
+			t.Fatalf("tests[%d] expected nil got %v", i, err)
+		}
+
+		if matches := testWalk(loaded); !reflect.DeepEqual(expected, matches) {
+			t.Errorf("tests[%d] expected %v got %v", i, expected, matches)
+		}
+
+		// new entries follow on from those already in the log
+		if i == 0 {
+			loaded.SaveFile(saved, 0)
+			loaded.AddHash(0x05)
+			expected = []Match{{0x01, 0, 1, nil}, {0x02, 0, 2, nil}, {0x03, 0, 1, nil}, {0x04, 0, 1, nil}, {0x05, 0, 1, nil}, {0x42, 0, 1, []uint64{1}}}
+		}
+		loaded.Close()
+	}
+}
+
+func TestDBWALCollections(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.wal")
+	options := WALOptions{Snapshot: filepath.Join(dir, "test.db")}
+	db := New()
+	db.Collection("x").AddHash(0x01)
+	db.OpenWAL(path, options)
+	db.Collection("x").AddHash(0x02)
+	db.Collection("x").putRecord(ImageInfo{Hash: 0x42, Location: "a.png"})
+	db.Checkpoint()
+
+	db.Collection("x").AddHash(0x03)
+	db.Collection("x").Collection("y").AddHash(0x04)
+	db.Collection("z").AddHash(0x05)
+	db.RemoveCollection("z")
+	db.SetCollection("w", New())
+	db.Collection("w").AddHash(0x06)
+
+	// what a collection held when it was set isn't logged
+	v := New()
+	v.AddHash(0x07)
+	db.Collection("v").AddHash(0x08)
+	db.SetCollection("v", v)
+	v.AddHash(0x09)
+	db.Close()
+
+	loaded := New()
+	loaded.LoadFile(options.Snapshot)
+	if err := loaded.OpenWAL(path, options); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer func() { loaded.Close() }()
+
+	if names := loaded.Collections(); !reflect.DeepEqual([]string{"v", "w", "x"}, names) {
+		t.Errorf("Expected [v w x] got %v", names)
+	}
+
+	// replayed collections keep writing to the log
+	loaded.Collection("v").AddHash(0x0a)
+	loaded.Close()
+	loaded = New()
+	loaded.LoadFile(options.Snapshot)
+	if err := loaded.OpenWAL(path, options); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	tests := []struct {
+		collection *DB
+		expected   []Match
+	}{
+		{loaded.Collection("x"), []Match{{0x01, 0, 1, nil}, {0x02, 0, 1, nil}, {0x03, 0, 1, nil}, {0x42, 0, 1, []uint64{1}}}},
+		{loaded.Collection("x").Collection("y"), []Match{{0x04, 0, 1, nil}}},
+		{loaded.Collection("w"), []Match{{0x06, 0, 1, nil}}},
+		{loaded.Collection("v"), []Match{{0x09, 0, 1, nil}, {0x0a, 0, 1, nil}}},
+		{loaded, nil},
+	}
+
+	for i, test := range tests {
+		if matches := testWalk(test.collection); !reflect.DeepEqual(test.expected, matches) {
+			t.Errorf("tests[%d] expected %v got %v", i, test.expected, matches)
+		}
+	}
+
+	if err := loaded.Collection("x").Checkpoint(); err != ErrNoWAL {
+		t.Errorf("Expected %v got %v", ErrNoWAL, err)
+	}
+}
+
+func TestDBWALCollectionsCheckpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	// collections keep writing while their database checkpoints
+	path := filepath.Join(dir, "test.wal")
+	options := WALOptions{Snapshot: filepath.Join(dir, "test.db"), CheckpointAfter: 10}
+	db := New()
+	db.OpenWAL(path, options)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 500; i++ {
+			db.Collection("x").AddHash(PHash(i))
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 500; i++ {
+		db.AddHash(PHash(i))
+	}
+	<-done
+	db.Close()
+
+	loaded := New()
+	loaded.LoadFile(options.Snapshot)
+	if err := loaded.OpenWAL(path, options); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer loaded.Close()
+
+	for i, collection := range []*DB{loaded, loaded.Collection("x")} {
+		matches := testWalk(collection)
+		if len(matches) != 500 {
+			t.Errorf("tests[%d] expected 500 hashes got %v", i, len(matches))
+		}
+
+		for _, match := range matches {
+			if match.Count != 1 {
+				t.Errorf("tests[%d] expected %v once got %v", i, match.Hash, match.Count)
+				break
+			}
+		}
+	}
+}
+
+func TestWALDiscard(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.wal")
+	db := New()
+	db.OpenWAL(path, WALOptions{})
+	defer db.Close()
+	db.AddHash(0x01)
+	stat, _ := os.Stat(path)
+	db.AddHash(0x02)
+	db.AddHash(0x03)
+
+	// entries written after a checkpoint starts are kept
+	w := db.wal
+	if err := w.discard(stat.Size()); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if w.entries != 2 {
+		t.Errorf("Expected 2 got %v", w.entries)
+	}
+
+	db.AddHash(0x04)
+	expected := `{"seq":2,"op":"insert","hashes":["0000000000000002"]}
+{"seq":3,"op":"insert","hashes":["0000000000000003"]}
+{"seq":4,"op":"insert","hashes":["0000000000000004"]}
+`
+	if buf, _ := ioutil.ReadFile(path); string(buf) != expected {
+		t.Errorf("Expected %q got %q", expected, buf)
+	}
+}
+
+func TestDBWALCorrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	tests := []string{
+		"not json\n",
+		`{"seq":1,"op":"unknown"}` + "\n",
+		`{"seq":1,"op":"add"}` + "\n",
+		`{"op":"insert","hashes":["0000000000000001"]}` + "\n",
+	}
+
+	path := filepath.Join(dir, "test.wal")
+	for i, test := range tests {
+		ioutil.WriteFile(path, []byte(test), 0644)
+		if err := New().OpenWAL(path, WALOptions{}); err != ErrCorrupt {
+			t.Errorf("tests[%d] expected %v got %v", i, ErrCorrupt, err)
+		}
+	}
+}
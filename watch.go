@@ -0,0 +1,156 @@
+package disgo
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultWatchDelay is how long a file must go without being written to
+// before a Watcher adds it to the database
+const DefaultWatchDelay = 500 * time.Millisecond
+
+// Watcher keeps a DB up to date with the image files in a set of watched
+// directories.  Files are added (or rehashed) once they have stopped
+// changing for the watcher's delay, so partially written files are not
+// decoded.  Records are removed when files are deleted or renamed away
+type Watcher struct {
+	// OnError, if set, is called with any errors that occur while
+	// processing file system events
+	OnError func(error)
+
+	db      *DB
+	delay   time.Duration
+	watcher *fsnotify.Watcher
+	pending map[string]*time.Timer
+	ready   chan string
+	stopped chan struct{}
+}
+
+// NewWatcher creates a Watcher that updates db.  Call Watch to begin
+// observing directories and Close to stop
+func NewWatcher(db *DB, delay time.Duration) (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		db:      db,
+		delay:   delay,
+		watcher: watcher,
+		pending: make(map[string]*time.Timer),
+		ready:   make(chan string),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Watch adds root and all of its subdirectories to the watch list and
+// scans them so the database reflects their current content.  Files the
+// scan can't add are passed to OnError rather than failing the watch
+func (w *Watcher) Watch(root string) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			err = w.watcher.Add(path)
+		}
+		return err
+	})
+
+	if err == nil {
+		err = w.db.Scan(root)
+	}
+
+	if scanErr, ok := err.(*ScanError); ok {
+		for _, fileErr := range scanErr.Files {
+			w.error(fileErr)
+		}
+		err = nil
+	}
+	return err
+}
+
+// Close stops watching all directories
+func (w *Watcher) Close() error {
+	err := w.watcher.Close()
+	<-w.stopped
+	return err
+}
+
+func (w *Watcher) error(err error) {
+	if err != nil && err != ErrNotFound && w.OnError != nil {
+		w.OnError(err)
+	}
+}
+
+func (w *Watcher) run() {
+	defer func() {
+		for _, timer := range w.pending {
+			timer.Stop()
+		}
+		close(w.stopped)
+	}()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.error(err)
+		case path := <-w.ready:
+			delete(w.pending, path)
+			w.update(path)
+		}
+	}
+}
+
+func (w *Watcher) handle(event fsnotify.Event) {
+	switch {
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if timer, found := w.pending[event.Name]; found {
+			timer.Stop()
+			delete(w.pending, event.Name)
+		}
+		w.error(w.db.removeUnder(event.Name, nil))
+	case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			w.error(w.Watch(event.Name))
+			return
+		}
+
+		if _, err := imaging.FormatFromFilename(event.Name); err != nil {
+			return
+		}
+
+		if timer, found := w.pending[event.Name]; found {
+			timer.Reset(w.delay)
+			return
+		}
+
+		path := event.Name
+		w.pending[path] = time.AfterFunc(w.delay, func() {
+			select {
+			case w.ready <- path:
+			case <-w.stopped:
+			}
+		})
+	}
+}
+
+func (w *Watcher) update(path string) {
+	_, err := w.db.AddPath(path)
+	if os.IsNotExist(err) {
+		err = w.db.RemovePath(path)
+	}
+	w.error(err)
+}
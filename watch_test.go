@@ -0,0 +1,100 @@
+package disgo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, desc string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	existing := filepath.Join(dir, "existing.png")
+	writeTestImage(t, existing, 0)
+
+	db := New()
+	watcher, err := NewWatcher(db, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer watcher.Close()
+	watcher.OnError = func(err error) { t.Errorf("Unexpected error %v", err) }
+
+	if err := watcher.Watch(dir); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if _, err := db.Record(existing); err != nil {
+		t.Errorf("Expected existing image to be scanned got %v", err)
+	}
+
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0755)
+	// give the watcher a chance to pick up the new directory
+	time.Sleep(50 * time.Millisecond)
+
+	created := filepath.Join(sub, "created.png")
+	writeTestImage(t, created, 0x81)
+	waitFor(t, "created image", func() bool {
+		_, err := db.Record(created)
+		return err == nil
+	})
+
+	renamed := filepath.Join(dir, "renamed.png")
+	os.Rename(created, renamed)
+	waitFor(t, "renamed image", func() bool {
+		_, err1 := db.Record(created)
+		_, err2 := db.Record(renamed)
+		return err1 == ErrNotFound && err2 == nil
+	})
+
+	os.Remove(existing)
+	waitFor(t, "removed image", func() bool {
+		_, err := db.Record(existing)
+		return err == ErrNotFound
+	})
+}
+
+func TestWatcherScanErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disgo")
+	defer os.RemoveAll(dir)
+
+	bad := filepath.Join(dir, "bad.png")
+	good := filepath.Join(dir, "good.png")
+	ioutil.WriteFile(bad, []byte("not a png"), 0644)
+	writeTestImage(t, good, 0)
+
+	db := New()
+	watcher, err := NewWatcher(db, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+	defer watcher.Close()
+
+	var errs []error
+	watcher.OnError = func(err error) { errs = append(errs, err) }
+	if err := watcher.Watch(dir); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if len(errs) != 1 {
+		t.Errorf("Expected 1 error got %v", errs)
+	}
+
+	if _, err := db.Record(good); err != nil {
+		t.Errorf("Expected good image to be scanned got %v", err)
+	}
+}